@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// How long a user has to wait before a beacon triggers its action for them again, by default
+const defaultBeaconCooldown time.Duration = 5 * time.Minute
+
+// Types of beacon events
+const (
+	BeaconEnter  = "enter"
+	BeaconBanner = "banner"
+	BeaconStay   = "stay"
+)
+
+// What the bot does when a user comes near a beacon
+type BeaconSettings struct {
+	// Name of the command that is run, e.g. "find zombie"
+	Command string `json:"command"`
+
+	// Beacon event types that trigger the command. Defaults to enter.
+	Events []string `json:"events,omitempty"`
+
+	// How long to wait before the command is run for the same user again, e.g. "10m".
+	// Defaults to 5 minutes, 0 runs it every time.
+	Cooldown string `json:"cooldown,omitempty"`
+
+	cooldown time.Duration
+}
+
+// Returns true if the beacon event type triggers the command
+func (s BeaconSettings) triggeredBy(beaconType string) bool {
+
+	if len(s.Events) == 0 {
+		return beaconType == BeaconEnter
+	}
+
+	for _, t := range s.Events {
+
+		if t == beaconType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Parse the BEACONS setting, a JSON object of hardware IDs to beacon settings
+func parseBeacons(value string) (map[string]BeaconSettings, error) {
+
+	var beacons map[string]BeaconSettings
+
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&beacons); err != nil {
+		return nil, err
+	}
+
+	for hwid, settings := range beacons {
+
+		if settings.Command == "" {
+			return nil, fmt.Errorf("beacon %s: command is required", hwid)
+		}
+
+		for _, t := range settings.Events {
+
+			if t != BeaconEnter && t != BeaconBanner && t != BeaconStay {
+				return nil, fmt.Errorf("beacon %s: unknown event type %q", hwid, t)
+			}
+		}
+
+		settings.cooldown = defaultBeaconCooldown
+
+		if settings.Cooldown != "" {
+
+			cooldown, err := time.ParseDuration(settings.Cooldown)
+
+			if err != nil || cooldown < 0 {
+				return nil, fmt.Errorf("beacon %s: cooldown must be a duration such as 10m: %s", hwid, settings.Cooldown)
+			}
+
+			settings.cooldown = cooldown
+		}
+
+		beacons[hwid] = settings
+	}
+
+	return beacons, nil
+}
+
+// The settings for a beacon. Beacons that aren't listed use the "*" entry, if there is one.
+func (cfg *Config) beaconSettings(hwid string) (BeaconSettings, bool) {
+
+	if settings, ok := cfg.Beacons[hwid]; ok {
+		return settings, true
+	}
+
+	settings, ok := cfg.Beacons["*"]
+
+	return settings, ok
+}
+
+// Remembers when beacons last triggered for each user. Kept for the whole process, so that
+// reloading the config doesn't reset the cooldowns.
+var beaconCooldowns = NewMemoryIdempotencyStore(defaultBeaconCooldown)
+
+// Function that handles users coming near a beacon. Runs the command configured for the beacon,
+// unless the user triggered it recently.
+func ProcessBeaconEvent(ctx context.Context, b *Bot, e Event) error {
+
+	logger := loggerFrom(ctx)
+
+	logger.Info("Processing beacon event", "hwid", e.Beacon.Hwid, "beaconType", e.Beacon.Type, "dm", e.Beacon.Dm)
+
+	settings, ok := b.Config.beaconSettings(e.Beacon.Hwid)
+
+	if !ok || !settings.triggeredBy(e.Beacon.Type) {
+		logger.Debug("No action for beacon", "hwid", e.Beacon.Hwid, "beaconType", e.Beacon.Type)
+		return nil
+	}
+
+	key := strings.Join([]string{b.Config.ChannelId, e.Beacon.Hwid, e.Source.UserId}, "|")
+
+	if settings.cooldown > 0 && !beaconCooldowns.ClaimFor(key, settings.cooldown) {
+		logger.Info("Beacon is cooling down for the user", "hwid", e.Beacon.Hwid, "command", settings.Command)
+		return nil
+	}
+
+	// The device message is passed to the command as the text, so scenario replies can use it as {{text}}
+	found, err := b.Commands.Run(ctx, b, e, settings.Command, Message{Type: "beacon", Text: e.Beacon.Dm})
+
+	if !found {
+		err = fmt.Errorf("beacon %s: unknown command %q", e.Beacon.Hwid, settings.Command)
+	}
+
+	// Let a redelivery of the event try again
+	if err != nil {
+		beaconCooldowns.Release(key)
+	}
+
+	return err
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// A bot whose beacon runs a command that counts how often it was called
+func beaconTestBot(t *testing.T, s *fakeLINEServer, cooldown string, failures *int) (*Bot, *int) {
+
+	t.Helper()
+
+	b := s.bot(t)
+
+	beacons, err := parseBeacons(`{"beacon1": {"command": "greet", "cooldown": "` + cooldown + `"}}`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.Config.Beacons = beacons
+
+	calls := 0
+
+	err = b.Commands.Register(Command{Name: "greet", Trigger: TriggerExact, Pattern: "greet", Handler: func(ctx context.Context, b *Bot, e Event, m Message) error {
+
+		calls++
+
+		if *failures > 0 {
+			*failures--
+			return errors.New("greeting failed")
+		}
+
+		return nil
+	}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b, &calls
+}
+
+func beaconEvent(userId string) Event {
+
+	return Event{
+		Type:   "beacon",
+		Source: Source{Type: "user", UserId: userId},
+		Beacon: Beacon{Hwid: "beacon1", Type: BeaconEnter},
+	}
+}
+
+func TestBeaconCooldown(t *testing.T) {
+
+	previous := beaconCooldowns
+	beaconCooldowns = NewMemoryIdempotencyStore(defaultBeaconCooldown)
+	defer func() { beaconCooldowns = previous }()
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	failures := 0
+	b, calls := beaconTestBot(t, s, "50ms", &failures)
+
+	for _, userId := range []string{"U1", "U1", "U2"} {
+
+		if err := ProcessBeaconEvent(context.Background(), b, beaconEvent(userId)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The second event of U1 is cooling down
+	if *calls != 2 {
+		t.Errorf("command ran %d times, want 2", *calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if err := ProcessBeaconEvent(context.Background(), b, beaconEvent("U1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if *calls != 3 {
+		t.Errorf("command ran %d times after the cooldown, want 3", *calls)
+	}
+}
+
+func TestBeaconWithoutCooldown(t *testing.T) {
+
+	previous := beaconCooldowns
+	beaconCooldowns = NewMemoryIdempotencyStore(defaultBeaconCooldown)
+	defer func() { beaconCooldowns = previous }()
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	failures := 0
+	b, calls := beaconTestBot(t, s, "0", &failures)
+
+	for i := 0; i < 3; i++ {
+
+		if err := ProcessBeaconEvent(context.Background(), b, beaconEvent("U1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if *calls != 3 {
+		t.Errorf("command ran %d times, want 3", *calls)
+	}
+}
+
+// A failed command resets the cooldown, so that a redelivery of the event runs it again
+func TestBeaconCooldownResetOnError(t *testing.T) {
+
+	previous := beaconCooldowns
+	beaconCooldowns = NewMemoryIdempotencyStore(defaultBeaconCooldown)
+	defer func() { beaconCooldowns = previous }()
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	failures := 1
+	b, calls := beaconTestBot(t, s, "1h", &failures)
+
+	if err := ProcessBeaconEvent(context.Background(), b, beaconEvent("U1")); err == nil {
+		t.Fatal("failed command returned no error")
+	}
+
+	if err := ProcessBeaconEvent(context.Background(), b, beaconEvent("U1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ProcessBeaconEvent(context.Background(), b, beaconEvent("U1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if *calls != 2 {
+		t.Errorf("command ran %d times, want 2", *calls)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Bot holds everything the event handlers need to respond to a webhook
+type Bot struct {
+	Config   *Config
+	Client   *Client
+	Commands *CommandRouter
+
+	// Handlers of signed postback data, keyed by action
+	Postbacks *PostbackRouter
+
+	// Replies loaded from the scenario file. Nil if no scenario is used.
+	Scenario *Scenario
+}
+
+func NewBot(cfg *Config, client *Client, scenario *Scenario) (*Bot, error) {
+
+	b := &Bot{
+		Config:    cfg,
+		Client:    client,
+		Commands:  NewCommandRouter(),
+		Postbacks: NewPostbackRouter(),
+		Scenario:  scenario,
+	}
+
+	if err := registerDefaultCommands(b.Commands); err != nil {
+		return nil, err
+	}
+
+	if err := registerDefaultPostbacks(b.Postbacks); err != nil {
+		return nil, err
+	}
+
+	if scenario != nil {
+
+		if err := scenario.RegisterCommands(b.Commands); err != nil {
+			return nil, err
+		}
+	}
+
+	for hwid, settings := range cfg.Beacons {
+
+		if b.Commands.Lookup(settings.Command) == nil {
+			return nil, fmt.Errorf("beacon %s: unknown command %q", hwid, settings.Command)
+		}
+	}
+
+	return b, nil
+}
+
+// The bots of all served channels, keyed by channel ID. The default channel has an empty ID.
+type Bots map[string]*Bot
+
+// Files that the bots were loaded from, which are watched for changes
+func (bots Bots) watchedFiles() []string {
+
+	seen := make(map[string]bool)
+	var files []string
+
+	for _, b := range bots {
+
+		for _, path := range []string{b.Config.ConfigFile, b.Config.ScenarioFile} {
+
+			if path != "" && !seen[path] {
+				seen[path] = true
+				files = append(files, path)
+			}
+		}
+	}
+
+	return files
+}
+
+// Keeps one client per channel, so that rate limits and quota tracking carry over when the
+// bots are reloaded. A channel's client is replaced when the settings it was built from change.
+type channelClients struct {
+	// Stops the clients' background work
+	ctx context.Context
+	wg  sync.WaitGroup
+
+	mu      sync.Mutex
+	clients map[string]*channelClient
+}
+
+type channelClient struct {
+	client   *Client
+	settings clientSettings
+
+	// Stops the client's background work. Nil if it has none.
+	stop context.CancelFunc
+}
+
+// The settings a client is built from
+type clientSettings struct {
+	accessToken string
+	apiEndpoint string
+	apiTimeout  time.Duration
+	rateLimits  map[string]RateLimit
+	quotaBudget int64
+	queuePushes bool
+}
+
+func newClientSettings(cfg *Config) clientSettings {
+
+	return clientSettings{
+		accessToken: cfg.ChannelAccessToken,
+		apiEndpoint: cfg.APIEndpoint,
+		apiTimeout:  cfg.APITimeout,
+		rateLimits:  cfg.RateLimits,
+		quotaBudget: cfg.MessageQuotaBudget,
+		queuePushes: cfg.QueuePushWhenQuotaExhausted,
+	}
+}
+
+// The clients of a configuration that is being loaded. Nothing changes until they are committed,
+// so a configuration that fails to load leaves the running clients alone.
+type clientUpdate struct {
+	cc      *channelClients
+	clients map[string]*channelClient
+}
+
+func (cc *channelClients) update() *clientUpdate {
+	return &clientUpdate{cc: cc, clients: make(map[string]*channelClient)}
+}
+
+// The client for the channel of the config. The running client is kept if its settings are
+// the same. Otherwise a new one is built, which keeps the rate limiter and quota tracker of the
+// old one if their settings didn't change.
+func (u *clientUpdate) get(cfg *Config) *Client {
+
+	if existing, ok := u.clients[cfg.ChannelId]; ok {
+		return existing.client
+	}
+
+	u.cc.mu.Lock()
+	existing := u.cc.clients[cfg.ChannelId]
+	u.cc.mu.Unlock()
+
+	settings := newClientSettings(cfg)
+
+	if existing != nil && reflect.DeepEqual(existing.settings, settings) {
+		u.clients[cfg.ChannelId] = existing
+		return existing.client
+	}
+
+	client := NewClientFromConfig(cfg)
+
+	if existing != nil {
+
+		if reflect.DeepEqual(existing.settings.rateLimits, settings.rateLimits) {
+			client.RateLimiter = existing.client.RateLimiter
+		}
+
+		if existing.settings.quotaBudget == settings.quotaBudget && existing.settings.queuePushes == settings.queuePushes {
+			client.Quota = existing.client.Quota
+		}
+	}
+
+	u.clients[cfg.ChannelId] = &channelClient{client: client, settings: settings}
+
+	return client
+}
+
+// Make the clients of the update the running ones. Clients that were replaced or whose channel
+// was removed stop their background work.
+func (u *clientUpdate) commit() {
+
+	u.cc.mu.Lock()
+	defer u.cc.mu.Unlock()
+
+	for channelId, old := range u.cc.clients {
+
+		if u.clients[channelId] == old {
+			continue
+		}
+
+		if _, ok := u.clients[channelId]; ok {
+			rootLogger.Info("Client settings of the channel changed, replacing its client", "channel", channelLabel(channelId))
+		} else {
+			rootLogger.Info("Channel was removed, stopping its client", "channel", channelLabel(channelId))
+		}
+
+		if old.stop != nil {
+			old.stop()
+		}
+	}
+
+	for _, c := range u.clients {
+
+		if c.stop != nil || c.client.Quota == nil {
+			continue
+		}
+
+		ctx, stop := context.WithCancel(u.cc.ctx)
+		c.stop = stop
+
+		u.cc.wg.Add(1)
+
+		go func(client *Client) {
+			defer u.cc.wg.Done()
+			client.Quota.Run(ctx, client)
+		}(c.client)
+	}
+
+	u.cc.clients = u.clients
+}
+
+// Wait for the clients' background work to stop after their context is done
+func (cc *channelClients) wait() {
+	cc.wg.Wait()
+}
+
+// Create the bots for every channel in the config
+func loadBots(cfg *Config, clients *channelClients) (Bots, error) {
+
+	bots := make(Bots)
+	update := clients.update()
+
+	for channelId, channelCfg := range cfg.ServedChannels() {
+
+		scenario, err := LoadScenarioFromConfig(channelCfg)
+
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := NewBot(channelCfg, update.get(channelCfg), scenario)
+
+		if err != nil {
+			return nil, err
+		}
+
+		bots[channelId] = b
+	}
+
+	update.commit()
+
+	return bots, nil
+}
+
+// Logger for a channel's client. Logs of channels other than the default one include the channel ID.
+func channelLogger(channelId string) *Logger {
+
+	if channelId == "" {
+		return rootLogger
+	}
+
+	return rootLogger.With("channel", channelId)
+}
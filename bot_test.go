@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func clientTestConfig(channelId string, token string) *Config {
+
+	cfg := testConfig()
+	cfg.ChannelId = channelId
+	cfg.ChannelAccessToken = token
+	cfg.APIEndpoint = "http://127.0.0.1:1/v2/bot/"
+	cfg.APITimeout = time.Second
+	cfg.MessageQuotaBudget = -1
+
+	return cfg
+}
+
+func TestChannelClientsReuseClientsWithTheSameSettings(t *testing.T) {
+
+	cc := &channelClients{ctx: context.Background()}
+
+	u := cc.update()
+	first := u.get(clientTestConfig("a", "token"))
+	u.commit()
+
+	u = cc.update()
+	second := u.get(clientTestConfig("a", "token"))
+	u.commit()
+
+	if first != second {
+		t.Error("client was replaced although its settings didn't change")
+	}
+}
+
+func TestChannelClientsReplaceClientsWhenTheTokenChanges(t *testing.T) {
+
+	cc := &channelClients{ctx: context.Background()}
+
+	u := cc.update()
+	first := u.get(clientTestConfig("a", "old-token"))
+	u.commit()
+
+	u = cc.update()
+	second := u.get(clientTestConfig("a", "new-token"))
+	u.commit()
+
+	if first == second {
+		t.Fatal("client was kept although the access token changed")
+	}
+
+	if second.AccessToken != "new-token" {
+		t.Errorf("access token = %q, want new-token", second.AccessToken)
+	}
+
+	// The rate limit state carries over
+	if first.RateLimiter != second.RateLimiter {
+		t.Error("rate limiter was not carried over")
+	}
+}
+
+func TestChannelClientsUncommittedUpdateChangesNothing(t *testing.T) {
+
+	cc := &channelClients{ctx: context.Background()}
+
+	u := cc.update()
+	first := u.get(clientTestConfig("a", "old-token"))
+	u.commit()
+
+	// A reload that fails after building its clients
+	cc.update().get(clientTestConfig("a", "new-token"))
+
+	u = cc.update()
+
+	if got := u.get(clientTestConfig("a", "old-token")); got != first {
+		t.Error("running client was replaced by an update that was not committed")
+	}
+}
+
+func TestChannelClientsStopRemovedChannels(t *testing.T) {
+
+	cc := &channelClients{ctx: context.Background()}
+
+	cfg := clientTestConfig("a", "token")
+	cfg.MessageQuotaBudget = 0
+
+	u := cc.update()
+	u.get(cfg)
+	u.get(clientTestConfig("b", "token"))
+	u.commit()
+
+	// Channel a is removed by the reload
+	u = cc.update()
+	u.get(clientTestConfig("b", "token"))
+	u.commit()
+
+	done := make(chan struct{})
+
+	go func() {
+		cc.wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("quota tracking of the removed channel is still running")
+	}
+}
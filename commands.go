@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+)
+
+// Register the commands the bot responds to
+func registerDefaultCommands(r *CommandRouter) error {
+
+	commands := []Command{
+		{
+			Name:        "help",
+			Description: "Lists the commands I understand",
+			Trigger:     TriggerExact,
+			Pattern:     "help",
+			Priority:    100,
+			Handler:     HelpCommand,
+		},
+		{
+			Name:        "imagemap",
+			Description: "Sends an imagemap",
+			Trigger:     TriggerKeyword,
+			Pattern:     "imagemap",
+			Priority:    50,
+			Handler:     ImagemapCommand,
+		},
+		{
+			Name:        "goodbye",
+			Description: "Makes me leave this chat",
+			Trigger:     TriggerKeyword,
+			Pattern:     "goodbye",
+			Priority:    40,
+			Sources:     []string{"group", "room"},
+			Handler:     GoodbyeCommand,
+		},
+		{
+			Name:        "push",
+			Description: "Sends a push message",
+			Trigger:     TriggerKeyword,
+			Pattern:     "push",
+			Priority:    30,
+			Handler:     PushCommand,
+		},
+		{
+			Name:        "multizombie",
+			Description: "Sends a carousel of zombies",
+			Trigger:     TriggerKeyword,
+			Pattern:     "multizombie",
+			Priority:    20,
+			Handler:     MultiZombieCommand,
+		},
+		{
+			Name:        "find zombie",
+			Description: "Sends a zombie encounter",
+			Trigger:     TriggerKeyword,
+			Pattern:     "find zombie",
+			Priority:    20,
+			Handler:     FindZombieCommand,
+		},
+		{
+			Name:        "schedule zombie attack",
+			Description: "Lets you pick when the zombies attack",
+			Trigger:     TriggerKeyword,
+			Pattern:     "schedule zombie attack",
+			Priority:    25,
+			Handler:     ScheduleZombieAttackCommand,
+		},
+		{
+			Name:        "explode",
+			Description: "Asks if you want to explode",
+			Trigger:     TriggerKeyword,
+			Pattern:     "explode",
+			Priority:    10,
+			Handler:     ExplodeCommand,
+		},
+	}
+
+	for _, cmd := range commands {
+
+		if err := r.Register(cmd); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Command that replies with the list of available commands
+func HelpCommand(ctx context.Context, b *Bot, e Event, m Message) error {
+
+	replyMessage := ReplyMessage{
+		Type: "text",
+		Text: b.Commands.HelpText(e.Source.Type),
+	}
+
+	return b.Client.SendReplyMessage(ctx, e.ReplyToken, []ReplyMessage{replyMessage})
+
+}
+
+// Command that sends an imagemap with two choices
+func ImagemapCommand(ctx context.Context, b *Bot, e Event, m Message) error {
+
+	err := SendImageMap(ctx, b, e.ReplyToken)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// Command that makes the bot leave the group or room
+func GoodbyeCommand(ctx context.Context, b *Bot, e Event, m Message) error {
+
+	var err error
+
+	switch e.Source.Type {
+
+	case "room":
+
+		err = b.Client.LeaveGroupOrRoom(ctx, e.Source.Type, e.Source.RoomId)
+
+	case "group":
+
+		err = b.Client.LeaveGroupOrRoom(ctx, e.Source.Type, e.Source.GroupId)
+
+	default:
+
+		err = errors.New("Invalid Source Type: " + e.Source.Type)
+
+	}
+
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+
+}
+
+// Command that sends a push message without using the reply token
+func PushCommand(ctx context.Context, b *Bot, e Event, m Message) error {
+
+	message1 := ReplyMessage{
+		Type: "text",
+		Text: "This is a PUSH Message! I am not using your reply token at all.",
+	}
+
+	message2 := ReplyMessage{
+		Type:      "sticker",
+		StickerId: "19",
+		PackageId: "2",
+	}
+
+	var toId string = e.Source.UserId
+
+	switch e.Source.Type {
+
+	case "group":
+		toId = e.Source.GroupId
+	case "room":
+		toId = e.Source.RoomId
+
+	}
+
+	err := b.Client.SendPushMessage(ctx, []ReplyMessage{message1, message2}, toId)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// Command that sends a confirm dialog asking if the user wants to explode
+func ExplodeCommand(ctx context.Context, b *Bot, e Event, m Message) error {
+
+	loggerFrom(ctx).Info("Processing explode command")
+
+	noExplodeData, err := b.EncodePostback(e.Source, "noexplode", nil)
+
+	if err != nil {
+		return err
+	}
+
+	templateAction1 := TemplateAction{
+		Type:  "uri",
+		Label: "YES!",
+		Uri:   b.Config.staticUrl("explode.jpg"),
+	}
+
+	templateAction2 := TemplateAction{
+		Type:  "postback",
+		Label: "NO!",
+		Data:  noExplodeData,
+	}
+
+	templateActions := []TemplateAction{templateAction1, templateAction2}
+
+	template := Template{
+		Type:    "confirm",
+		Text:    "Are you SURE you want to explode?",
+		Actions: templateActions,
+	}
+
+	confirmMessage := ReplyMessage{
+		AltText:  "This is a confirm template",
+		Type:     "template",
+		Template: template,
+	}
+
+	err = b.Client.SendReplyMessage(ctx, e.ReplyToken, []ReplyMessage{confirmMessage})
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// Command that sends a buttons template with a zombie encounter
+func FindZombieCommand(ctx context.Context, b *Bot, e Event, m Message) error {
+
+	loggerFrom(ctx).Info("Processing find zombie command")
+
+	runData, err := b.EncodePostback(e.Source, "run", nil)
+
+	if err != nil {
+		return err
+	}
+
+	templateAction1 := TemplateAction{
+		Type:  "postback",
+		Label: "Run!",
+		Data:  runData,
+		Text:  "I'm outta here!!",
+	}
+
+	templateAction2 := TemplateAction{
+		Type:  "message",
+		Label: "Scream!",
+		Text:  "AHHHHHH!",
+	}
+
+	templateAction3 := TemplateAction{
+		Type:  "uri",
+		Label: "EXPLODE!",
+		Uri:   b.Config.staticUrl("explode.jpg"),
+	}
+
+	templateActions := []TemplateAction{templateAction1, templateAction2, templateAction3}
+
+	template := Template{
+		Type:              "buttons",
+		ThumbnailImageUrl: b.Config.staticUrl("zombiemessage.jpg"),
+		Title:             "You have encountered a ZOMBIE!!",
+		Text:              "What do you do?!?",
+		Actions:           templateActions,
+	}
+
+	buttonMessage := ReplyMessage{
+		AltText:  "This is a buttons template",
+		Type:     "template",
+		Template: template,
+	}
+
+	err = b.Client.SendReplyMessage(ctx, e.ReplyToken, []ReplyMessage{buttonMessage})
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// Command that sends a buttons template with a datetime picker for scheduling a zombie attack.
+// The picked time comes back as a zombie_attack postback.
+func ScheduleZombieAttackCommand(ctx context.Context, b *Bot, e Event, m Message) error {
+
+	loggerFrom(ctx).Info("Processing schedule zombie attack command")
+
+	attackData, err := b.EncodePostback(e.Source, "zombie_attack", nil)
+
+	if err != nil {
+		return err
+	}
+
+	// The picker shows the times in the user's time zone
+	now := time.Now().In(b.Config.TimeZone)
+
+	pickerAction, err := NewDatetimePickerAction("Pick a time", attackData, DatetimePickerDatetime, now.Add(time.Hour), now, now.AddDate(0, 1, 0))
+
+	if err != nil {
+		return err
+	}
+
+	template := Template{
+		Type:              "buttons",
+		ThumbnailImageUrl: b.Config.staticUrl("zombiemessage.jpg"),
+		Title:             "Schedule a zombie attack",
+		Text:              "When should the zombies attack?",
+		Actions:           []TemplateAction{pickerAction},
+	}
+
+	buttonMessage := ReplyMessage{
+		AltText:  "This is a buttons template",
+		Type:     "template",
+		Template: template,
+	}
+
+	err = b.Client.SendReplyMessage(ctx, e.ReplyToken, []ReplyMessage{buttonMessage})
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// Command that sends a carousel with multiple zombie encounters
+func MultiZombieCommand(ctx context.Context, b *Bot, e Event, m Message) error {
+
+	loggerFrom(ctx).Info("Processing multizombie command")
+
+	// The run postback says which zombie the user ran from
+	zombieActions := func(zombie string) ([]TemplateAction, error) {
+
+		runData, err := b.EncodePostback(e.Source, "run", url.Values{"zombie": {zombie}})
+
+		if err != nil {
+			return nil, err
+		}
+
+		templateAction1 := TemplateAction{
+			Type:  "postback",
+			Label: "Run!",
+			Data:  runData,
+			Text:  "I'm outta here!!",
+		}
+
+		templateAction2 := TemplateAction{
+			Type:  "message",
+			Label: "Scream!",
+			Text:  "AHHHHHH!",
+		}
+
+		templateAction3 := TemplateAction{
+			Type:  "uri",
+			Label: "EXPLODE!",
+			Uri:   b.Config.staticUrl("explode.jpg"),
+		}
+
+		return []TemplateAction{templateAction1, templateAction2, templateAction3}, nil
+	}
+
+	var columns []Column
+
+	for _, zombie := range []string{"1", "2", "3"} {
+
+		actions, err := zombieActions(zombie)
+
+		if err != nil {
+			return err
+		}
+
+		columns = append(columns, Column{
+			ThumbnailImageUrl: b.Config.staticUrl("zombiemessage.jpg"),
+			Title:             "Zombie " + zombie,
+			Text:              "You have encoutered Zombie " + zombie + "!",
+			Actions:           actions,
+		})
+	}
+
+	template := Template{
+		Type:              "carousel",
+		ThumbnailImageUrl: b.Config.staticUrl("zombiemessage.jpg"),
+		Title:             "You have encountered a ZOMBIE!!",
+		Text:              "What do you do?!?",
+		Actions:           columns[0].Actions,
+		Columns:           columns,
+	}
+
+	carouselMessage := ReplyMessage{
+		AltText:  "This is a Carousel template",
+		Type:     "template",
+		Template: template,
+	}
+
+	err := b.Client.SendReplyMessage(ctx, e.ReplyToken, []ReplyMessage{carouselMessage})
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
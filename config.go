@@ -0,0 +1,784 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// All settings the bot reads from its config file and the environment
+var configKeys = []string{
+	"USE_REAL_ENVIRONMENT",
+	"BOT_HOST",
+	"STATIC_ASSETS_URL",
+	"BETA_LINE_CHANNEL_SECRET",
+	"REAL_LINE_CHANNEL_SECRET",
+	"BETA_LINE_CHANNEL_ACCESS_TOKEN",
+	"REAL_LINE_CHANNEL_ACCESS_TOKEN",
+	"SKIP_SIGNATURE_VERIFICATION",
+	"POSTBACK_SECRET",
+	"PORT",
+	"LINE_API_ENDPOINT",
+	"LINE_API_TIMEOUT",
+	"LINE_RATE_LIMITS",
+	"MESSAGE_QUOTA_BUDGET",
+	"QUEUE_PUSH_WHEN_QUOTA_EXHAUSTED",
+	"SCENARIO_FILE",
+	"MAX_STORED_IMAGES",
+	"TIME_ZONE",
+	"CHANNELS",
+	"GROUPS",
+	"BEACONS",
+	"EVENT_WORKERS",
+	"EVENT_QUEUE_DEPTH",
+	"EVENT_QUEUE_FULL",
+	"WEBHOOK_EVENT_TTL",
+	"DEAD_LETTER_FILE",
+	"DEAD_LETTER_REDACT",
+	"WEBHOOK_MAX_SKEW",
+	"WEBHOOK_MAX_REDELIVERY_AGE",
+	"SHUTDOWN_TIMEOUT",
+	"MAX_WEBHOOK_BODY_SIZE",
+	"LOG_LEVEL",
+	"LOG_REDACT",
+	"TRACE_EXPORTER",
+	"OTEL_EXPORTER_OTLP_ENDPOINT",
+	"OTEL_SERVICE_NAME",
+}
+
+// Settings that apply to the whole process and can't be set per channel
+var processConfigKeys = map[string]bool{
+	"PORT":                        true,
+	"CHANNELS":                    true,
+	"EVENT_WORKERS":               true,
+	"EVENT_QUEUE_DEPTH":           true,
+	"EVENT_QUEUE_FULL":            true,
+	"WEBHOOK_EVENT_TTL":           true,
+	"DEAD_LETTER_FILE":            true,
+	"DEAD_LETTER_REDACT":          true,
+	"WEBHOOK_MAX_SKEW":            true,
+	"WEBHOOK_MAX_REDELIVERY_AGE":  true,
+	"SHUTDOWN_TIMEOUT":            true,
+	"MAX_WEBHOOK_BODY_SIZE":       true,
+	"LOG_LEVEL":                   true,
+	"LOG_REDACT":                  true,
+	"TRACE_EXPORTER":              true,
+	"OTEL_EXPORTER_OTLP_ENDPOINT": true,
+	"OTEL_SERVICE_NAME":           true,
+}
+
+// Channel IDs are used in webhook urls
+var validChannelId = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Config holds the bot's settings. It is loaded once at startup (and on reload) and passed to
+// everything that needs it, instead of each function reading the environment itself.
+type Config struct {
+	// The config file the settings were read from, if any
+	ConfigFile string
+
+	// ID of the channel these settings are for. Empty for the default channel served at /api/.
+	ChannelId string
+
+	// Additional channels served at /api/{channelId}/, keyed by channel ID. Each one has the
+	// top-level settings, overridden by the settings given for the channel in CHANNELS.
+	Channels map[string]*Config
+
+	// True if the default channel is served. When CHANNELS is set, the default channel is only
+	// served if it has its own access token.
+	ServeDefaultChannel bool
+
+	UseRealEnvironment bool
+
+	// Base url of the bot, used to build links to the files it serves. Always ends with a slash.
+	BotHost string
+	// Base url of the static images. Defaults to the images/static directory served by the bot.
+	StaticAssetsUrl string
+
+	// Credentials of the channel in the selected (beta or real) environment
+	ChannelSecret      string
+	ChannelAccessToken string
+
+	// Key that postback data is signed with. Defaults to the channel secret.
+	PostbackSecret string
+
+	SkipSignatureVerification bool
+
+	Port string
+
+	APIEndpoint string
+	APITimeout  time.Duration
+	RateLimits  map[string]RateLimit
+
+	// Monthly message budget. Negative if quota tracking is disabled.
+	MessageQuotaBudget          int64
+	QueuePushWhenQuotaExhausted bool
+
+	// The scenario file, and whether it has to exist
+	ScenarioFile     string
+	ScenarioRequired bool
+
+	// How many downloaded files the image directory may hold
+	MaxStoredImages int
+
+	// Time zone of the bot's users, used for the times they pick and are shown
+	TimeZone *time.Location
+
+	// How members joining and leaving groups are treated, keyed by group or room ID
+	Groups map[string]GroupSettings
+
+	// What happens when users come near beacons, keyed by hardware ID
+	Beacons map[string]BeaconSettings
+
+	// Number of workers handling webhook events, how many events can wait for them, and what
+	// happens to webhooks when the queue is full (reject, block or drop)
+	EventWorkers    int
+	EventQueueDepth int
+	EventQueueFull  string
+
+	// How long webhook event IDs are remembered to skip redelivered events. Zero disables deduplication.
+	WebhookEventTTL time.Duration
+
+	// File that events which could not be handled are appended to
+	DeadLetterFile string
+
+	// Whether events are redacted like the logs before they are written to the dead-letter file.
+	// Redacted events can't be replayed.
+	DeadLetterRedact bool
+
+	// How far event timestamps may be from the current time before a webhook is rejected as a
+	// replay. Zero disables replay protection.
+	WebhookMaxSkew time.Duration
+
+	// How old the events of a redelivered webhook may be before it is rejected as a replay
+	WebhookMaxRedeliveryAge time.Duration
+
+	// How long to wait for webhooks and queued events on SIGTERM before giving up
+	ShutdownTimeout time.Duration
+
+	// Webhook bodies larger than this many bytes are rejected with 413
+	MaxWebhookBodySize int64
+
+	// Entries below this level are not logged
+	LogLevel Level
+
+	// What is replaced in logs: user IDs, reply tokens, message text and authorization headers
+	LogRedactions []string
+
+	// Where spans are exported: none, stdout or otlp
+	TraceExporter string
+
+	// Base url of the OpenTelemetry collector that OTLP spans are sent to
+	OTLPEndpoint string
+
+	// Service name reported with the spans
+	ServiceName string
+}
+
+// Collects all validation errors, so that they can be reported at once
+type configErrors []string
+
+func (e *configErrors) add(format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf(format, args...))
+}
+
+// Parse the command line flags. Flags take precedence over the config file and the environment.
+// Returns the settings they override, keyed like the environment variables.
+func ParseFlags(args []string) (map[string]string, error) {
+
+	flags := flag.NewFlagSet("line_bot_test_app_v2", flag.ContinueOnError)
+
+	configFile := flags.String("config", "", "path of a JSON config file (default $CONFIG_FILE)")
+	port := flags.String("port", "", "port to listen on (default $PORT or 12345)")
+	botHost := flags.String("bot-host", "", "base url of the bot (default $BOT_HOST)")
+	scenarioFile := flags.String("scenario", "", "path of the scenario file (default $SCENARIO_FILE)")
+	real := flags.Bool("real", false, "use the real environment instead of beta")
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	overrides := make(map[string]string)
+
+	set := func(key string, value string) {
+
+		if value != "" {
+			overrides[key] = value
+		}
+	}
+
+	set("CONFIG_FILE", *configFile)
+	set("PORT", *port)
+	set("BOT_HOST", *botHost)
+	set("SCENARIO_FILE", *scenarioFile)
+
+	if *real {
+		overrides["USE_REAL_ENVIRONMENT"] = "TRUE"
+	}
+
+	return overrides, nil
+}
+
+// Convert a setting from a JSON config file to the string it would have as an environment variable
+func configValue(key string, value interface{}) (string, error) {
+
+	switch v := value.(type) {
+	case bool:
+		return strings.ToUpper(strconv.FormatBool(v)), nil
+	case string, json.Number:
+		return fmt.Sprint(v), nil
+	case map[string]interface{}:
+
+		// CHANNELS, GROUPS and BEACONS are objects in the config file, but JSON strings in the environment
+		if key == "CHANNELS" || key == "GROUPS" || key == "BEACONS" {
+
+			data, err := json.Marshal(v)
+
+			return string(data), err
+		}
+	}
+
+	return "", fmt.Errorf("%s must be a string, number or boolean", key)
+}
+
+// Read a config file. It is a JSON object using the same keys as the environment variables.
+func readConfigFile(path string) (map[string]string, error) {
+
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	values := make(map[string]string)
+
+	for key, value := range raw {
+
+		if !isConfigKey(key) {
+			return nil, fmt.Errorf("%s: unknown setting %q", path, key)
+		}
+
+		v, err := configValue(key, value)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+
+		values[key] = v
+	}
+
+	return values, nil
+}
+
+// Load the config from the config file, the environment and the flag overrides (in increasing
+// order of precedence) and validate it.
+func LoadConfig(overrides map[string]string) (*Config, error) {
+
+	configFile := overrides["CONFIG_FILE"]
+
+	if configFile == "" {
+		configFile = os.Getenv("CONFIG_FILE")
+	}
+
+	values := make(map[string]string)
+
+	if configFile != "" {
+
+		fileValues, err := readConfigFile(configFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		values = fileValues
+	}
+
+	for _, key := range configKeys {
+
+		if value, ok := os.LookupEnv(key); ok {
+			values[key] = value
+		}
+	}
+
+	for key, value := range overrides {
+		values[key] = value
+	}
+
+	cfg, err := parseConfig(values)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.ConfigFile = configFile
+
+	for _, channelCfg := range cfg.Channels {
+		channelCfg.ConfigFile = configFile
+	}
+
+	return cfg, nil
+}
+
+func parseConfig(values map[string]string) (*Config, error) {
+
+	var errs configErrors
+
+	channels, err := parseChannels(values)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Without any other channels, the default channel must be valid. Otherwise it is optional.
+	requireCredentials := len(channels) == 0 || values["BETA_LINE_CHANNEL_ACCESS_TOKEN"] != "" || values["REAL_LINE_CHANNEL_ACCESS_TOKEN"] != ""
+
+	cfg := parseChannelConfig(values, requireCredentials, &errs)
+	cfg.ServeDefaultChannel = requireCredentials
+	cfg.Channels = make(map[string]*Config)
+
+	for channelId, channelValues := range channels {
+
+		var channelErrs configErrors
+
+		channelCfg := parseChannelConfig(channelValues, true, &channelErrs)
+		channelCfg.ChannelId = channelId
+
+		for _, e := range channelErrs {
+			errs.add("channel %s: %s", channelId, e)
+		}
+
+		cfg.Channels[channelId] = channelCfg
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.New("invalid configuration:\n  " + strings.Join(errs, "\n  "))
+	}
+
+	return cfg, nil
+}
+
+// Parse the CHANNELS setting into the settings of each channel, which are the top-level settings
+// overridden by the channel's own
+func parseChannels(values map[string]string) (map[string]map[string]string, error) {
+
+	channels := make(map[string]map[string]string)
+
+	if values["CHANNELS"] == "" {
+		return channels, nil
+	}
+
+	var raw map[string]map[string]interface{}
+
+	decoder := json.NewDecoder(strings.NewReader(values["CHANNELS"]))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("CHANNELS must be a JSON object of channel IDs to settings: %v", err)
+	}
+
+	for channelId, settings := range raw {
+
+		if !validChannelId.MatchString(channelId) {
+			return nil, fmt.Errorf("invalid channel ID %q: only letters, digits, - and _ are allowed", channelId)
+		}
+
+		channelValues := make(map[string]string)
+
+		for key, value := range values {
+
+			if !processConfigKeys[key] {
+				channelValues[key] = value
+			}
+		}
+
+		for key, value := range settings {
+
+			if !isConfigKey(key) || processConfigKeys[key] {
+				return nil, fmt.Errorf("channel %s: %q can't be set per channel", channelId, key)
+			}
+
+			v, err := configValue(key, value)
+
+			if err != nil {
+				return nil, fmt.Errorf("channel %s: %v", channelId, err)
+			}
+
+			channelValues[key] = v
+		}
+
+		channels[channelId] = channelValues
+	}
+
+	return channels, nil
+}
+
+// Parse the settings of a single channel, adding any problems to errs
+func parseChannelConfig(values map[string]string, requireCredentials bool, errs *configErrors) *Config {
+
+	cfg := &Config{
+		UseRealEnvironment:          values["USE_REAL_ENVIRONMENT"] == "TRUE",
+		SkipSignatureVerification:   values["SKIP_SIGNATURE_VERIFICATION"] == "TRUE",
+		QueuePushWhenQuotaExhausted: values["QUEUE_PUSH_WHEN_QUOTA_EXHAUSTED"] == "TRUE",
+		Port:                        values["PORT"],
+		APIEndpoint:                 values["LINE_API_ENDPOINT"],
+		APITimeout:                  defaultRequestTimeout,
+		MessageQuotaBudget:          -1,
+		ScenarioFile:                values["SCENARIO_FILE"],
+		ScenarioRequired:            values["SCENARIO_FILE"] != "",
+		MaxStoredImages:             defaultMaxStoredImages,
+		TimeZone:                    time.UTC,
+		EventWorkers:                defaultEventWorkers,
+		EventQueueDepth:             defaultEventQueueDepth,
+		EventQueueFull:              QueueFullReject,
+		WebhookEventTTL:             defaultWebhookEventTTL,
+		DeadLetterFile:              defaultDeadLetterFile,
+		DeadLetterRedact:            values["DEAD_LETTER_REDACT"] == "TRUE",
+		WebhookMaxSkew:              defaultWebhookMaxSkew,
+		WebhookMaxRedeliveryAge:     defaultWebhookMaxRedeliveryAge,
+		ShutdownTimeout:             defaultShutdownTimeout,
+		MaxWebhookBodySize:          defaultMaxWebhookBodySize,
+		LogLevel:                    LevelInfo,
+		LogRedactions:               defaultRedactions,
+		TraceExporter:               TraceExporterNone,
+		OTLPEndpoint:                defaultOTLPEndpoint,
+		ServiceName:                 defaultServiceName,
+	}
+
+	environment := "BETA"
+	cfg.APIEndpoint = alphaApiEndpoint
+
+	if cfg.UseRealEnvironment {
+		environment = "REAL"
+		cfg.APIEndpoint = realApiEndpoint
+	}
+
+	if endpoint := values["LINE_API_ENDPOINT"]; endpoint != "" {
+		cfg.APIEndpoint = endpoint
+	}
+
+	if _, err := url.ParseRequestURI(cfg.APIEndpoint); err != nil {
+		errs.add("LINE_API_ENDPOINT is not a valid url: %s", cfg.APIEndpoint)
+	}
+
+	cfg.ChannelSecret = values[environment+"_LINE_CHANNEL_SECRET"]
+	cfg.ChannelAccessToken = values[environment+"_LINE_CHANNEL_ACCESS_TOKEN"]
+
+	if cfg.ChannelSecret == "" && !cfg.SkipSignatureVerification && requireCredentials {
+		errs.add("%s_LINE_CHANNEL_SECRET must be set unless SKIP_SIGNATURE_VERIFICATION is TRUE", environment)
+	}
+
+	if cfg.ChannelAccessToken == "" && requireCredentials {
+		errs.add("%s_LINE_CHANNEL_ACCESS_TOKEN must be set", environment)
+	}
+
+	cfg.PostbackSecret = values["POSTBACK_SECRET"]
+
+	if cfg.PostbackSecret == "" {
+		cfg.PostbackSecret = cfg.ChannelSecret
+	}
+
+	cfg.BotHost = values["BOT_HOST"]
+
+	if cfg.BotHost == "" {
+		errs.add("BOT_HOST must be set")
+	} else if u, err := url.Parse(cfg.BotHost); err != nil || u.Scheme == "" || u.Host == "" {
+		errs.add("BOT_HOST must be an absolute url such as https://example.com/: %s", cfg.BotHost)
+	} else if !strings.HasSuffix(cfg.BotHost, "/") {
+		cfg.BotHost += "/"
+	}
+
+	cfg.StaticAssetsUrl = values["STATIC_ASSETS_URL"]
+
+	if cfg.StaticAssetsUrl == "" {
+		cfg.StaticAssetsUrl = cfg.BotHost + "images/static/"
+	} else if !strings.HasSuffix(cfg.StaticAssetsUrl, "/") {
+		cfg.StaticAssetsUrl += "/"
+	}
+
+	// Default endpoint is 12345
+	if cfg.Port == "" {
+		cfg.Port = "12345"
+	}
+
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port < 1 || port > 65535 {
+		errs.add("PORT must be a port number: %s", cfg.Port)
+	}
+
+	if value := values["LINE_API_TIMEOUT"]; value != "" {
+
+		timeout, err := time.ParseDuration(value)
+
+		if err != nil || timeout < 0 {
+			errs.add("LINE_API_TIMEOUT must be a duration such as 10s: %s", value)
+		}
+
+		cfg.APITimeout = timeout
+	}
+
+	if value := values["LINE_RATE_LIMITS"]; value != "" {
+
+		limits, err := ParseRateLimits(value)
+
+		if err != nil {
+			errs.add("LINE_RATE_LIMITS: %v", err)
+		}
+
+		cfg.RateLimits = limits
+	}
+
+	if value := values["MESSAGE_QUOTA_BUDGET"]; value != "" {
+
+		budget, err := strconv.ParseInt(value, 10, 64)
+
+		if err != nil || budget < 0 {
+			errs.add("MESSAGE_QUOTA_BUDGET must be a number of messages: %s", value)
+		}
+
+		cfg.MessageQuotaBudget = budget
+	}
+
+	if cfg.ScenarioFile == "" {
+		cfg.ScenarioFile = defaultScenarioFile
+	}
+
+	if value := values["MAX_STORED_IMAGES"]; value != "" {
+
+		max, err := strconv.Atoi(value)
+
+		if err != nil || max < 1 {
+			errs.add("MAX_STORED_IMAGES must be a positive number: %s", value)
+		}
+
+		cfg.MaxStoredImages = max
+	}
+
+	if value := values["TIME_ZONE"]; value != "" {
+
+		loc, err := time.LoadLocation(value)
+
+		if err != nil {
+			errs.add("TIME_ZONE must be a time zone name such as Asia/Tokyo: %s", value)
+		} else {
+			cfg.TimeZone = loc
+		}
+	}
+
+	if value := values["GROUPS"]; value != "" {
+
+		decoder := json.NewDecoder(strings.NewReader(value))
+		decoder.DisallowUnknownFields()
+
+		if err := decoder.Decode(&cfg.Groups); err != nil {
+			errs.add("GROUPS must be a JSON object of group IDs to group settings: %v", err)
+		}
+	}
+
+	if value := values["BEACONS"]; value != "" {
+
+		beacons, err := parseBeacons(value)
+
+		if err != nil {
+			errs.add("BEACONS must be a JSON object of hardware IDs to beacon settings: %v", err)
+		}
+
+		cfg.Beacons = beacons
+	}
+
+	if value := values["EVENT_WORKERS"]; value != "" {
+
+		workers, err := strconv.Atoi(value)
+
+		if err != nil || workers < 1 {
+			errs.add("EVENT_WORKERS must be a positive number: %s", value)
+		}
+
+		cfg.EventWorkers = workers
+	}
+
+	if value := values["EVENT_QUEUE_DEPTH"]; value != "" {
+
+		depth, err := strconv.Atoi(value)
+
+		if err != nil || depth < 1 {
+			errs.add("EVENT_QUEUE_DEPTH must be a positive number: %s", value)
+		}
+
+		cfg.EventQueueDepth = depth
+	}
+
+	if value := values["EVENT_QUEUE_FULL"]; value != "" {
+
+		switch value {
+		case QueueFullReject, QueueFullBlock, QueueFullDrop:
+			cfg.EventQueueFull = value
+		default:
+			errs.add("EVENT_QUEUE_FULL must be reject, block or drop: %s", value)
+		}
+	}
+
+	if value := values["WEBHOOK_EVENT_TTL"]; value != "" {
+
+		ttl, err := time.ParseDuration(value)
+
+		if err != nil || ttl < 0 {
+			errs.add("WEBHOOK_EVENT_TTL must be a duration such as 24h: %s", value)
+		}
+
+		cfg.WebhookEventTTL = ttl
+	}
+
+	if value := values["DEAD_LETTER_FILE"]; value != "" {
+		cfg.DeadLetterFile = value
+	}
+
+	if value := values["WEBHOOK_MAX_SKEW"]; value != "" {
+
+		skew, err := time.ParseDuration(value)
+
+		if err != nil || skew < 0 {
+			errs.add("WEBHOOK_MAX_SKEW must be a duration such as 5m: %s", value)
+		}
+
+		cfg.WebhookMaxSkew = skew
+	}
+
+	if value := values["WEBHOOK_MAX_REDELIVERY_AGE"]; value != "" {
+
+		age, err := time.ParseDuration(value)
+
+		if err != nil || age <= 0 {
+			errs.add("WEBHOOK_MAX_REDELIVERY_AGE must be a positive duration such as 24h: %s", value)
+		}
+
+		cfg.WebhookMaxRedeliveryAge = age
+	}
+
+	if value := values["SHUTDOWN_TIMEOUT"]; value != "" {
+
+		timeout, err := time.ParseDuration(value)
+
+		if err != nil || timeout <= 0 {
+			errs.add("SHUTDOWN_TIMEOUT must be a positive duration such as 25s: %s", value)
+		}
+
+		cfg.ShutdownTimeout = timeout
+	}
+
+	if value := values["MAX_WEBHOOK_BODY_SIZE"]; value != "" {
+
+		size, err := strconv.ParseInt(value, 10, 64)
+
+		if err != nil || size < 1 {
+			errs.add("MAX_WEBHOOK_BODY_SIZE must be a positive number of bytes: %s", value)
+		}
+
+		cfg.MaxWebhookBodySize = size
+	}
+
+	if value := values["LOG_LEVEL"]; value != "" {
+
+		level, err := ParseLevel(value)
+
+		if err != nil {
+			errs.add("LOG_LEVEL must be debug, info, warn or error: %s", value)
+		}
+
+		cfg.LogLevel = level
+	}
+
+	if value := values["LOG_REDACT"]; value != "" {
+
+		cfg.LogRedactions = nil
+
+		for _, redaction := range strings.Split(value, ",") {
+
+			redaction = strings.TrimSpace(redaction)
+
+			if redaction == "none" {
+				continue
+			}
+
+			if _, ok := redactedFields[redaction]; !ok {
+				errs.add("LOG_REDACT must list userId, replyToken, text and authorization, or be none: %s", value)
+				break
+			}
+
+			cfg.LogRedactions = append(cfg.LogRedactions, redaction)
+		}
+	}
+
+	if value := values["TRACE_EXPORTER"]; value != "" {
+
+		switch value {
+		case TraceExporterNone, TraceExporterStdout, TraceExporterOTLP:
+			cfg.TraceExporter = value
+		default:
+			errs.add("TRACE_EXPORTER must be none, stdout or otlp: %s", value)
+		}
+	}
+
+	if value := values["OTEL_EXPORTER_OTLP_ENDPOINT"]; value != "" {
+		cfg.OTLPEndpoint = strings.TrimSuffix(value, "/")
+	}
+
+	if value := values["OTEL_SERVICE_NAME"]; value != "" {
+		cfg.ServiceName = value
+	}
+
+	return cfg
+}
+
+func isConfigKey(key string) bool {
+
+	for _, k := range configKeys {
+
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The settings of every channel that is served, keyed by channel ID
+func (cfg *Config) ServedChannels() map[string]*Config {
+
+	channels := make(map[string]*Config)
+
+	if cfg.ServeDefaultChannel {
+		channels[""] = cfg
+	}
+
+	for channelId, channelCfg := range cfg.Channels {
+		channels[channelId] = channelCfg
+	}
+
+	return channels
+}
+
+// Url of a file in the image directory, as served by the bot
+func (cfg *Config) imageUrl(fileName string) string {
+	return cfg.BotHost + "images/" + fileName
+}
+
+// Url of a static image
+func (cfg *Config) staticUrl(fileName string) string {
+	return cfg.StaticAssetsUrl + fileName
+}
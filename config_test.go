@@ -0,0 +1,277 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Settings of a valid single-channel config
+func validConfigValues() map[string]string {
+
+	return map[string]string{
+		"BOT_HOST":                       "https://bot.example/",
+		"BETA_LINE_CHANNEL_SECRET":       "secret",
+		"BETA_LINE_CHANNEL_ACCESS_TOKEN": "token",
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+
+	tests := []struct {
+		name string
+		set  map[string]string
+
+		// Substrings of the error, or nil if the config is valid
+		wantErrs []string
+		check    func(t *testing.T, cfg *Config)
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, cfg *Config) {
+
+				if cfg.Port != "12345" || cfg.APIEndpoint != alphaApiEndpoint || cfg.APITimeout != defaultRequestTimeout {
+					t.Errorf("port = %q, endpoint = %q, timeout = %v", cfg.Port, cfg.APIEndpoint, cfg.APITimeout)
+				}
+
+				if cfg.StaticAssetsUrl != "https://bot.example/images/static/" {
+					t.Errorf("static assets url = %q", cfg.StaticAssetsUrl)
+				}
+
+				if cfg.TimeZone != time.UTC {
+					t.Errorf("time zone = %v, want UTC", cfg.TimeZone)
+				}
+
+				if cfg.MessageQuotaBudget != -1 || cfg.MaxStoredImages != defaultMaxStoredImages {
+					t.Errorf("quota budget = %d, max stored images = %d", cfg.MessageQuotaBudget, cfg.MaxStoredImages)
+				}
+			},
+		},
+		{
+			name: "real environment",
+			set: map[string]string{
+				"USE_REAL_ENVIRONMENT":           "TRUE",
+				"REAL_LINE_CHANNEL_SECRET":       "real-secret",
+				"REAL_LINE_CHANNEL_ACCESS_TOKEN": "real-token",
+			},
+			check: func(t *testing.T, cfg *Config) {
+
+				if cfg.APIEndpoint != realApiEndpoint || cfg.ChannelSecret != "real-secret" || cfg.ChannelAccessToken != "real-token" {
+					t.Errorf("endpoint = %q, secret = %q, token = %q", cfg.APIEndpoint, cfg.ChannelSecret, cfg.ChannelAccessToken)
+				}
+			},
+		},
+		{
+			name: "durations and numbers",
+			set: map[string]string{
+				"LINE_API_TIMEOUT":           "5s",
+				"MESSAGE_QUOTA_BUDGET":       "100",
+				"MAX_STORED_IMAGES":          "7",
+				"LINE_RATE_LIMITS":           "message/push=10/s",
+				"WEBHOOK_MAX_REDELIVERY_AGE": "1h",
+			},
+			check: func(t *testing.T, cfg *Config) {
+
+				if cfg.APITimeout != 5*time.Second || cfg.MessageQuotaBudget != 100 || cfg.MaxStoredImages != 7 {
+					t.Errorf("timeout = %v, budget = %d, max stored images = %d", cfg.APITimeout, cfg.MessageQuotaBudget, cfg.MaxStoredImages)
+				}
+
+				if cfg.WebhookMaxRedeliveryAge != time.Hour {
+					t.Errorf("max redelivery age = %v", cfg.WebhookMaxRedeliveryAge)
+				}
+
+				if cfg.RateLimits["message/push"].Rate != 10 {
+					t.Errorf("rate limits = %v", cfg.RateLimits)
+				}
+			},
+		},
+		{
+			name: "postbacks are signed with the channel secret by default",
+			check: func(t *testing.T, cfg *Config) {
+
+				if cfg.PostbackSecret != "secret" {
+					t.Errorf("postback secret = %q, want the channel secret", cfg.PostbackSecret)
+				}
+			},
+		},
+		{
+			name: "postback secret",
+			set:  map[string]string{"POSTBACK_SECRET": "postback-secret"},
+			check: func(t *testing.T, cfg *Config) {
+
+				if cfg.PostbackSecret != "postback-secret" || string(cfg.postbackKey()) != "postback-secret" {
+					t.Errorf("postback secret = %q", cfg.PostbackSecret)
+				}
+			},
+		},
+		{
+			name:     "missing credentials",
+			set:      map[string]string{"BETA_LINE_CHANNEL_SECRET": "", "BETA_LINE_CHANNEL_ACCESS_TOKEN": ""},
+			wantErrs: []string{"BETA_LINE_CHANNEL_SECRET must be set", "BETA_LINE_CHANNEL_ACCESS_TOKEN must be set"},
+		},
+		{
+			name: "secret not needed without signature verification",
+			set:  map[string]string{"BETA_LINE_CHANNEL_SECRET": "", "SKIP_SIGNATURE_VERIFICATION": "TRUE"},
+		},
+		{
+			name: "time zone",
+			set:  map[string]string{"TIME_ZONE": "Asia/Tokyo"},
+			check: func(t *testing.T, cfg *Config) {
+
+				if cfg.TimeZone.String() != "Asia/Tokyo" {
+					t.Errorf("time zone = %v", cfg.TimeZone)
+				}
+			},
+		},
+		{
+			name:     "unknown time zone",
+			set:      map[string]string{"TIME_ZONE": "Mars/Olympus_Mons"},
+			wantErrs: []string{"TIME_ZONE must be a time zone name"},
+		},
+		{
+			name:     "relative bot host",
+			set:      map[string]string{"BOT_HOST": "bot.example"},
+			wantErrs: []string{"BOT_HOST must be an absolute url"},
+		},
+		{
+			name: "every invalid setting is reported",
+			set: map[string]string{
+				"LINE_API_TIMEOUT":           "soon",
+				"MAX_STORED_IMAGES":          "0",
+				"EVENT_QUEUE_FULL":           "explode",
+				"WEBHOOK_MAX_REDELIVERY_AGE": "0",
+			},
+			wantErrs: []string{"LINE_API_TIMEOUT", "MAX_STORED_IMAGES", "EVENT_QUEUE_FULL", "WEBHOOK_MAX_REDELIVERY_AGE"},
+		},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			values := validConfigValues()
+
+			for key, value := range tt.set {
+				values[key] = value
+			}
+
+			cfg, err := parseConfig(values)
+
+			if len(tt.wantErrs) == 0 {
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if tt.check != nil {
+					tt.check(t, cfg)
+				}
+
+				return
+			}
+
+			if err == nil {
+				t.Fatal("invalid config was accepted")
+			}
+
+			for _, want := range tt.wantErrs {
+
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseChannels(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		channels string
+		want     map[string]map[string]string
+		wantErr  string
+	}{
+		{name: "no channels", want: map[string]map[string]string{}},
+		{
+			name:     "channels inherit the top-level settings",
+			channels: `{"staging": {"BETA_LINE_CHANNEL_ACCESS_TOKEN": "staging-token", "MAX_STORED_IMAGES": 5}}`,
+			want: map[string]map[string]string{
+				"staging": {
+					"BOT_HOST":                       "https://bot.example/",
+					"BETA_LINE_CHANNEL_SECRET":       "secret",
+					"BETA_LINE_CHANNEL_ACCESS_TOKEN": "staging-token",
+					"MAX_STORED_IMAGES":              "5",
+				},
+			},
+		},
+		{name: "invalid JSON", channels: `["staging"]`, wantErr: "CHANNELS must be a JSON object"},
+		{name: "invalid channel ID", channels: `{"../x": {}}`, wantErr: "invalid channel ID"},
+		{name: "unknown setting", channels: `{"a": {"FAVOURITE_COLOUR": "red"}}`, wantErr: `"FAVOURITE_COLOUR" can't be set per channel`},
+		{name: "process-wide setting", channels: `{"a": {"PORT": "8080"}}`, wantErr: `"PORT" can't be set per channel`},
+		{name: "invalid value", channels: `{"a": {"MAX_STORED_IMAGES": [1]}}`, wantErr: "must be a string, number or boolean"},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			values := validConfigValues()
+			values["PORT"] = "8080"
+
+			if tt.channels != "" {
+				values["CHANNELS"] = tt.channels
+			}
+
+			got, err := parseChannels(values)
+
+			if tt.wantErr != "" {
+
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// CHANNELS and the process-wide settings are not part of the channels' settings
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("channels = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConfigWithChannels(t *testing.T) {
+
+	values := map[string]string{
+		"BOT_HOST":                    "https://bot.example/",
+		"SKIP_SIGNATURE_VERIFICATION": "TRUE",
+		"CHANNELS":                    `{"a": {"BETA_LINE_CHANNEL_ACCESS_TOKEN": "a-token"}, "b": {"BETA_LINE_CHANNEL_ACCESS_TOKEN": "b-token"}}`,
+	}
+
+	cfg, err := parseConfig(values)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a top-level token only the listed channels are served
+	served := cfg.ServedChannels()
+
+	if len(served) != 2 || served["a"].ChannelAccessToken != "a-token" || served["b"].ChannelId != "b" {
+		t.Errorf("served channels = %v", served)
+	}
+
+	// Errors name the channel they belong to
+	values["CHANNELS"] = `{"a": {"BETA_LINE_CHANNEL_ACCESS_TOKEN": "a-token", "LINE_API_TIMEOUT": "soon"}}`
+
+	if _, err := parseConfig(values); err == nil || !strings.Contains(err.Error(), "channel a: LINE_API_TIMEOUT") {
+		t.Errorf("err = %v, want an error for channel a", err)
+	}
+}
@@ -1,94 +1,183 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"github.com/nfnt/resize"
 	"image"
 	"image/jpeg"
 	"io"
 	"io/ioutil"
-	"log"
-	"math/rand"
-	"net/http"
 	"os"
-	"strconv"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
+// Directory that downloaded content and previews are stored in. It is served under /images/.
+var imageDirectory = "images"
+
+// Prefixes of the files that the bot creates in the image directory. Only these are ever cleaned up.
+var storedContentPrefixes = []string{"image_", "video_", "audio_", "p_image_"}
+
 // Create a preview image from the original image
 // TODO: Make this method work for the static images too
-func CreatePreviewImage(originalFileName string) string {
+func CreatePreviewImage(ctx context.Context, originalFileName string) (string, error) {
+
+	_, span := startSpan(ctx, "CreatePreviewImage", SpanKindInternal, "file", originalFileName)
+	defer span.End()
+
+	start := time.Now()
+	defer func() {
+		previewDuration.Observe(time.Since(start).Seconds())
+	}()
 
 	// Open File
-	file, err := os.Open("images/" + originalFileName)
+	file, err := os.Open(imageDirectory + "/" + originalFileName)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
+	defer file.Close()
+
 	//Read Image
 	image, _, err := image.Decode(file)
 	if err != nil {
-		log.Fatal(err)
+		span.SetError(err)
+		return "", err
 	}
 
-	log.Println("Image Read")
+	rootLogger.Debug("Image read", "file", originalFileName)
 
 	previewImageFileName := "p_" + originalFileName
 
-	previewImageFile, err := os.Create("images/" + previewImageFileName)
+	previewImageFile, err := os.Create(imageDirectory + "/" + previewImageFileName)
+	if err != nil {
+		return "", err
+	}
+
+	defer previewImageFile.Close()
 
 	//Resize image
 	resizedImage := resize.Resize(240, 240, image, resize.Lanczos3)
 
-	jpeg.Encode(previewImageFile, resizedImage, nil)
+	err = jpeg.Encode(previewImageFile, resizedImage, nil)
+	if err != nil {
+		span.SetError(err)
+		return "", err
+	}
+
+	return previewImageFileName, nil
 
-	return previewImageFileName
+}
+
+// Returns true if the file in the image directory was created by the bot
+func isStoredContent(fileName string) bool {
+
+	for _, prefix := range storedContentPrefixes {
+
+		if strings.HasPrefix(fileName, prefix) {
+			return true
+		}
+	}
 
+	return false
 }
 
-// This function checks to see if the number of files in the images directory is less than the max number.
+// Returns true if the message ID is safe to use in a file name
+func isValidMessageId(messageId string) bool {
+
+	if messageId == "" {
+		return false
+	}
+
+	for _, r := range messageId {
+
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Delete the content downloaded for a message and the previews made from it.
+// Returns the names of the deleted files.
+func DeleteMessageContent(messageId string) ([]string, error) {
+
+	if !isValidMessageId(messageId) {
+		return nil, fmt.Errorf("Invalid message ID: %q", messageId)
+	}
+
+	files, err := ioutil.ReadDir(imageDirectory)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+
+	for _, f := range files {
+
+		name := f.Name()
+
+		if f.IsDir() || !isStoredContent(name) {
+			continue
+		}
+
+		// image_<messageId>.jpg, p_image_<messageId>.jpg and so on
+		if !strings.HasSuffix(strings.TrimSuffix(name, filepath.Ext(name)), "_"+messageId) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(imageDirectory, name)); err != nil && !os.IsNotExist(err) {
+			return deleted, err
+		}
+
+		deleted = append(deleted, name)
+	}
+
+	return deleted, nil
+}
+
+// This function checks to see if the number of files in the images directory is more than the max number.
 // If it is, it deletes the oldest image
 
-func CleanImageDirectory() {
+func CleanImageDirectory(maxStoredImages int) {
 
 	//Get a slice of files in the images directory
-	files, _ := ioutil.ReadDir("images")
+	files, _ := ioutil.ReadDir(imageDirectory)
 
-	//Debug statement
+	var storedFiles []os.FileInfo
 
-	numberOfStoredImages := len(files)
+	for _, f := range files {
 
-	// TODO: Change the max number of stored images to a config item
-	if numberOfStoredImages > 30 {
+		// Ignore directories and files that are part of the bot, like the static images
+		if f.IsDir() == true || !isStoredContent(f.Name()) {
+			continue
+		}
+
+		storedFiles = append(storedFiles, f)
+	}
+
+	if len(storedFiles) > maxStoredImages {
 
 		var earliestModifiedTime time.Time
 		var earliestModifiedFileName string
 
-		for _, f := range files {
-
-			// Ignore file if it is a directory
-			if f.IsDir() == true {
-				continue
-			}
+		for _, f := range storedFiles {
 
 			// If this is the first element, set it as the earliest one
-			if earliestModifiedFileName == "" {
-
-				earliestModifiedTime = f.ModTime()
-				earliestModifiedFileName = f.Name()
-				continue
-			}
-
-			if earliestModifiedTime.Before(f.ModTime()) {
+			if earliestModifiedFileName == "" || f.ModTime().Before(earliestModifiedTime) {
 
 				earliestModifiedTime = f.ModTime()
 				earliestModifiedFileName = f.Name()
 			}
 		}
 
-		err := os.Remove(earliestModifiedFileName)
+		err := os.Remove(imageDirectory + "/" + earliestModifiedFileName)
 		if err != nil {
-			log.Fatal(err)
-
+			rootLogger.Warn("Failed to clean the image directory", "error", err)
 		}
 
 	}
@@ -97,92 +186,81 @@ func CleanImageDirectory() {
 
 // Function for downloading and temporarily storing images, sound, and videos
 // Returns the file name of the stored image
-func GetContent(mediaType string, mediaId string) string {
-
-	client := &http.Client{}
-	rand.Seed((time.Now().UTC().UnixNano()))
+func GetContent(ctx context.Context, b *Bot, mediaType string, mediaId string) (string, error) {
 
-	url := alphaApiEndpoint + "v2/bot/message/" + mediaId + "/content"
-
-	if os.Getenv("USE_REAL_ENVIRONMENT") == "TRUE" {
-
-		url = realApiEndpoint + "v2/bot/message/" + mediaId + "/content"
+	ctx, span := startSpan(ctx, "GetContent", SpanKindInternal, "mediaType", mediaType)
+	defer span.End()
 
+	// Files are named after the message, so that they can be deleted if the message is unsent
+	if !isValidMessageId(mediaId) {
+		return "", fmt.Errorf("Invalid message ID: %q", mediaId)
 	}
 
+	var fileName string
+
 	switch mediaType {
 
 	case "image":
-		// Clean the image directory before getting content
-		CleanImageDirectory()
 
-		imageFileName := "image_" + strconv.Itoa(rand.Intn(10000)) + ".jpg"
-		// Create output file
-		newFile, err := os.Create("images/" + imageFileName)
+		fileName = "image_" + mediaId + ".jpg"
 
-		req, err := http.NewRequest("GET", url, nil)
-		req.Header.Set("Authorization", "Bearer "+os.Getenv("LINE_CHANNEL_ACCESS_TOKEN"))
-		resp, err := client.Do(req)
+	case "video":
 
-		numBytesWritten, err := io.Copy(newFile, resp.Body)
-		if err != nil {
-			log.Fatal(err)
-		}
-		log.Println("Media ID: " + mediaId)
-		log.Printf("Downloaded %d byte file.\n", numBytesWritten)
-		log.Println("File name: " + imageFileName)
+		fileName = "video_" + mediaId + ".mp4"
 
-		//return the file name
-		return imageFileName
+	case "audio":
 
-	case "video":
+		fileName = "audio_" + mediaId + ".m4a"
 
-		CleanImageDirectory()
+	default:
 
-		videoFileName := "video_" + strconv.Itoa(rand.Intn(10000)) + ".mp4"
-		newFile, err := os.Create("images/" + videoFileName)
+		return "", fmt.Errorf("Unknown media type: %s", mediaType)
 
-		req, err := http.NewRequest("GET", url, nil)
-		req.Header.Set("Authorization", "Bearer "+os.Getenv("LINE_CHANNEL_ACCESS_TOKEN"))
-		resp, err := client.Do(req)
+	}
 
-		numBytesWritten, err := io.Copy(newFile, resp.Body)
-		if err != nil {
-			log.Fatal(err)
-		}
-		log.Println("Media ID: " + mediaId)
-		log.Printf("Downloaded %d byte file.\n", numBytesWritten)
-		log.Println("File name: " + videoFileName)
+	// Clean the image directory before getting content
+	CleanImageDirectory(b.Config.MaxStoredImages)
 
-		return videoFileName
+	content, err := b.Client.GetMessageContent(ctx, mediaId)
 
-	case "audio":
+	if err != nil {
+		span.SetError(err)
+		return "", err
+	}
 
-		CleanImageDirectory()
+	defer content.Close()
 
-		audioFileName := "audio_" + strconv.Itoa(rand.Intn(10000)) + ".m4a"
-		newFile, err := os.Create("images/" + audioFileName)
+	// Create output file
+	newFile, err := os.Create(imageDirectory + "/" + fileName)
 
-		req, err := http.NewRequest("GET", url, nil)
-		req.Header.Set("Authorization", "Bearer "+os.Getenv("LINE_CHANNEL_ACCESS_TOKEN"))
-		resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
 
-		numBytesWritten, err := io.Copy(newFile, resp.Body)
-		if err != nil {
-			log.Fatal(err)
-		}
-		log.Println("Media ID: " + mediaId)
-		log.Printf("Downloaded %d byte file.\n", numBytesWritten)
-		log.Println("File name: " + audioFileName)
+	defer newFile.Close()
 
-		return audioFileName
+	numBytesWritten, err := io.Copy(newFile, content)
 
-	default:
+	contentDownloadBytes.Add(float64(numBytesWritten), mediaType)
+	span.SetAttributes("bytes", numBytesWritten)
+
+	if err != nil {
+
+		span.SetError(err)
 
-		log.Println("Unknown media type")
+		// A truncated file would be served as if it were the whole content
+		newFile.Close()
 
-		return ""
+		if removeErr := os.Remove(imageDirectory + "/" + fileName); removeErr != nil {
+			loggerFrom(ctx).Warn("Failed to remove partially downloaded content", "file", fileName, "error", removeErr)
+		}
 
+		return "", err
 	}
 
+	loggerFrom(ctx).Info("Downloaded message content", "messageId", mediaId, "bytes", numBytesWritten, "file", fileName)
+
+	//return the file name
+	return fileName, nil
+
 }
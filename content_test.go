@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Use a temporary image directory holding the given files. The returned function restores it.
+func useTestImageDirectory(t *testing.T, files ...string) func() {
+
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "images")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range files {
+
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	previous := imageDirectory
+	imageDirectory = dir
+
+	return func() {
+		imageDirectory = previous
+		os.RemoveAll(dir)
+	}
+}
+
+func imageDirectoryFiles(t *testing.T) []string {
+
+	t.Helper()
+
+	files, err := ioutil.ReadDir(imageDirectory)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func TestDeleteMessageContent(t *testing.T) {
+
+	defer useTestImageDirectory(t,
+		"image_1001.jpg",
+		"p_image_1001.jpg",
+		"video_1001.mp4",
+		"audio_1001.m4a",
+		"image_21001.jpg",
+		"image_10011.jpg",
+		"notes_1001.txt",
+		"zombiemessage.jpg",
+	)()
+
+	deleted, err := DeleteMessageContent("1001")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(deleted)
+
+	if want := "[audio_1001.m4a image_1001.jpg p_image_1001.jpg video_1001.mp4]"; "["+strings.Join(deleted, " ")+"]" != want {
+		t.Errorf("deleted %v, want %s", deleted, want)
+	}
+
+	// Other messages' content and files the bot didn't download are kept
+	if kept, want := imageDirectoryFiles(t), "[image_10011.jpg image_21001.jpg notes_1001.txt zombiemessage.jpg]"; "["+strings.Join(kept, " ")+"]" != want {
+		t.Errorf("kept %v, want %s", kept, want)
+	}
+}
+
+func TestDeleteMessageContentRejectsInvalidIds(t *testing.T) {
+
+	defer useTestImageDirectory(t, "image_1001.jpg")()
+
+	for _, messageId := range []string{"", "../x", "..", "1001/../1001", "1001.jpg", "*"} {
+
+		if _, err := DeleteMessageContent(messageId); err == nil {
+			t.Errorf("DeleteMessageContent(%q) was accepted", messageId)
+		}
+	}
+
+	if len(imageDirectoryFiles(t)) != 1 {
+		t.Error("files were deleted for an invalid message ID")
+	}
+}
+
+func TestGetContent(t *testing.T) {
+
+	defer useTestImageDirectory(t)()
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	s.respond("message/1001/content", http.StatusOK, "video bytes")
+
+	fileName, err := GetContent(context.Background(), s.bot(t), "video", "1001")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(imageDirectory, fileName))
+
+	if fileName != "video_1001.mp4" || string(content) != "video bytes" {
+		t.Errorf("stored %q with %q, %v", fileName, content, err)
+	}
+
+	if _, err := GetContent(context.Background(), s.bot(t), "video", "../1001"); err == nil {
+		t.Error("invalid message ID was accepted")
+	}
+}
+
+// A download that breaks off doesn't leave a truncated file behind
+func TestGetContentRemovesPartialFiles(t *testing.T) {
+
+	defer useTestImageDirectory(t)()
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	s.handle("message/1001/content", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.Write([]byte("only part of the video"))
+	})
+
+	if _, err := GetContent(context.Background(), s.bot(t), "video", "1001"); err == nil {
+		t.Fatal("truncated download returned no error")
+	}
+
+	if files := imageDirectoryFiles(t); len(files) != 0 {
+		t.Errorf("files left behind: %v", files)
+	}
+}
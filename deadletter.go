@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// File that events which could not be handled are written to by default
+const defaultDeadLetterFile string = "dead_letters.jsonl"
+
+// An event that could not be handled, as written to the dead-letter log
+type DeadLetter struct {
+	Time      time.Time `json:"time"`
+	ChannelId string    `json:"channelId,omitempty"`
+	Error     string    `json:"error"`
+
+	// The event as it was received, unless the log redacts it
+	Event interface{} `json:"event"`
+}
+
+// Appends failed events to a file, one JSON object per line, so that they can be replayed later.
+// The file holds message text and user IDs, so only its owner can read it.
+type DeadLetterLog struct {
+	path string
+
+	// If set, entries are redacted like the log entries of this logger
+	redact *Logger
+
+	mu sync.Mutex
+}
+
+func NewDeadLetterLog(path string, redact *Logger) *DeadLetterLog {
+	return &DeadLetterLog{path: path, redact: redact}
+}
+
+func (d *DeadLetterLog) Write(channelId string, event Event, cause error) error {
+
+	entry := DeadLetter{
+		Time:      time.Now(),
+		ChannelId: channelId,
+		Error:     cause.Error(),
+		Event:     event,
+	}
+
+	if d.redact != nil {
+		entry.Event = d.redact.redactValue("event", event)
+	}
+
+	line, err := json.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	file, err := os.OpenFile(d.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(line, '\n'))
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Remove the entries of the events of a message from the log, so that nothing of an unsent
+// message is kept. Returns the number of entries removed.
+func (d *DeadLetterLog) Scrub(messageId string) (int, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	content, err := ioutil.ReadFile(d.path)
+
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	var kept bytes.Buffer
+	removed := 0
+
+	for _, line := range bytes.SplitAfter(content, []byte("\n")) {
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var entry struct {
+			Event struct {
+				Message struct {
+					Id string `json:"id"`
+				} `json:"message"`
+			} `json:"event"`
+		}
+
+		// Entries that can't be read are kept as they are
+		if json.Unmarshal(line, &entry) == nil && entry.Event.Message.Id == messageId {
+			removed++
+			continue
+		}
+
+		kept.Write(line)
+	}
+
+	if removed == 0 {
+		return 0, nil
+	}
+
+	// Replace the file at once, so that a crash doesn't leave half of the log behind
+	tmp := d.path + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, kept.Bytes(), 0600); err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(tmp, d.path); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+
+	return removed, nil
+}
+
+// Collects the results of the events of one webhook, and reports the failures together once
+// all of them have been handled
+type webhookBatch struct {
+	logger *Logger
+
+	mu        sync.Mutex
+	total     int
+	remaining int
+	errs      []string
+}
+
+func newWebhookBatch(logger *Logger, size int) *webhookBatch {
+	return &webhookBatch{logger: logger, total: size, remaining: size}
+}
+
+// Record the result of one event. Returns the errors of the failed events once the last event
+// is done, or nil if none failed.
+func (wb *webhookBatch) done(event Event, err error) []string {
+
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	if err != nil {
+		wb.errs = append(wb.errs, fmt.Sprintf("%s event %s: %v", event.Type, event.WebhookEventId, err))
+	}
+
+	wb.remaining--
+
+	if wb.remaining > 0 || len(wb.errs) == 0 {
+		return nil
+	}
+
+	return wb.errs
+}
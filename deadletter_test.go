@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func deadLetterTestEvent(messageId string) Event {
+
+	return Event{
+		Type:       "message",
+		ReplyToken: "reply-token",
+		Source:     Source{Type: "user", UserId: "U123"},
+		Message:    json.RawMessage(`{"id": "` + messageId + `", "type": "text", "text": "secret message"}`),
+	}
+}
+
+func TestDeadLetterLogWrite(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		event   Event
+		redact  *Logger
+		want    []string
+		wantNot []string
+	}{
+		{
+			name:  "full entries by default",
+			event: deadLetterTestEvent("1001"),
+			want:  []string{"secret message", "reply-token", "U123"},
+		},
+		{
+			name:    "redacted like the logs",
+			event:   deadLetterTestEvent("1001"),
+			redact:  NewLogger(ioutil.Discard, LevelInfo, defaultRedactions),
+			want:    []string{`"id":"1001"`, `"text":"[redacted]"`, `"replyToken":"[redacted]"`},
+			wantNot: []string{"secret message", "reply-token", "U123"},
+		},
+		{
+			name:    "postback data holds the user's ID",
+			event:   Event{Type: "postback", Source: Source{Type: "user", UserId: "U123"}, Postback: Postback{Data: "v=1&a=run&c=U123&s=signature"}},
+			redact:  NewLogger(ioutil.Discard, LevelInfo, defaultRedactions),
+			want:    []string{`"data":"[redacted]"`},
+			wantNot: []string{"U123", "signature"},
+		},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			dir, err := ioutil.TempDir("", "deadletters")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "dead_letters.jsonl")
+			d := NewDeadLetterLog(path, tt.redact)
+
+			if err := d.Write("channel", tt.event, errors.New("boom")); err != nil {
+				t.Fatal(err)
+			}
+
+			content, err := ioutil.ReadFile(path)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Entries hold message text and user IDs
+			if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+				t.Errorf("file mode = %v, want 0600", info.Mode().Perm())
+			}
+
+			for _, want := range tt.want {
+
+				if !strings.Contains(string(content), want) {
+					t.Errorf("entry %s doesn't contain %s", content, want)
+				}
+			}
+
+			for _, unwanted := range tt.wantNot {
+
+				if strings.Contains(string(content), unwanted) {
+					t.Errorf("entry %s contains %s", content, unwanted)
+				}
+			}
+		})
+	}
+}
+
+// Full entries can be read back into the event they were written for
+func TestDeadLetterLogEntriesCanBeReplayed(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "deadletters")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dead_letters.jsonl")
+	event := deadLetterTestEvent("1001")
+
+	if err := NewDeadLetterLog(path, nil).Write("channel", event, errors.New("boom")); err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := ioutil.ReadFile(path)
+
+	var entry struct {
+		ChannelId string `json:"channelId"`
+		Error     string `json:"error"`
+		Event     Event  `json:"event"`
+	}
+
+	if err := json.Unmarshal(content, &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.ChannelId != "channel" || entry.Error != "boom" || entry.Event.Source != event.Source || entry.Event.ReplyToken != event.ReplyToken {
+		t.Errorf("entry = %+v", entry)
+	}
+
+	var m Message
+
+	if err := json.Unmarshal(entry.Event.Message, &m); err != nil || m.Text != "secret message" {
+		t.Errorf("message = %+v, %v", m, err)
+	}
+}
+
+// Redacted entries can still be scrubbed by message ID
+func TestDeadLetterLogScrub(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "deadletters")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dead_letters.jsonl")
+	d := NewDeadLetterLog(path, NewLogger(ioutil.Discard, LevelInfo, defaultRedactions))
+
+	for _, id := range []string{"1001", "1002", "1001"} {
+
+		if err := d.Write("", deadLetterTestEvent(id), errors.New("boom")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := d.Scrub("1001")
+
+	if err != nil || removed != 2 {
+		t.Fatalf("Scrub = %d, %v, want 2 entries removed", removed, err)
+	}
+
+	content, _ := ioutil.ReadFile(path)
+
+	if lines := strings.Count(string(content), "\n"); lines != 1 || !strings.Contains(string(content), `"id":"1002"`) {
+		t.Errorf("log after scrubbing = %s", content)
+	}
+}
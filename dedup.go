@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How long processed webhook event IDs are remembered by default
+const defaultWebhookEventTTL time.Duration = 24 * time.Hour
+
+// Remembers which webhook events have been processed, so that redelivered events are not handled twice.
+// The in-memory store is used by default. Other implementations can persist the IDs across restarts.
+type IdempotencyStore interface {
+	// Record that the event is being processed. Returns false if it already was.
+	Claim(webhookEventId string) (bool, error)
+
+	// Forget an event that could not be processed, so that a redelivery of it is handled again
+	Release(webhookEventId string) error
+}
+
+// IdempotencyStore that keeps event IDs in memory until they expire
+type MemoryIdempotencyStore struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+func NewMemoryIdempotencyStore(ttl time.Duration) *MemoryIdempotencyStore {
+
+	return &MemoryIdempotencyStore{
+		ttl:       ttl,
+		seen:      make(map[string]time.Time),
+		lastPrune: time.Now(),
+	}
+}
+
+func (s *MemoryIdempotencyStore) Claim(webhookEventId string) (bool, error) {
+
+	return s.ClaimFor(webhookEventId, s.ttl), nil
+}
+
+// Claim the key for the given time instead of the store's TTL. Returns false if it is still claimed.
+func (s *MemoryIdempotencyStore) ClaimFor(key string, ttl time.Duration) bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	// Expired IDs are removed every now and then so that the map doesn't grow forever
+	if now.Sub(s.lastPrune) > s.ttl/10 {
+
+		for id, expires := range s.seen {
+
+			if now.After(expires) {
+				delete(s.seen, id)
+			}
+		}
+
+		s.lastPrune = now
+	}
+
+	if expires, ok := s.seen[key]; ok && now.Before(expires) {
+		return false
+	}
+
+	s.seen[key] = now.Add(ttl)
+
+	return true
+}
+
+func (s *MemoryIdempotencyStore) Release(webhookEventId string) error {
+
+	s.mu.Lock()
+	delete(s.seen, webhookEventId)
+	s.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+
+	s := NewMemoryIdempotencyStore(time.Hour)
+
+	tests := []struct {
+		name    string
+		action  func() (bool, error)
+		wantNew bool
+	}{
+		{"first claim", func() (bool, error) { return s.Claim("a") }, true},
+		{"second claim", func() (bool, error) { return s.Claim("a") }, false},
+		{"other event", func() (bool, error) { return s.Claim("b") }, true},
+		{"claim after release", func() (bool, error) { s.Release("a"); return s.Claim("a") }, true},
+	}
+
+	// The steps depend on each other, so they run in order
+	for _, tt := range tests {
+
+		ok, err := tt.action()
+
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if ok != tt.wantNew {
+			t.Errorf("%s = %v, want %v", tt.name, ok, tt.wantNew)
+		}
+	}
+}
+
+func TestMemoryIdempotencyStoreExpiry(t *testing.T) {
+
+	s := NewMemoryIdempotencyStore(10 * time.Millisecond)
+
+	if ok, _ := s.Claim("a"); !ok {
+		t.Fatal("first claim failed")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if ok, _ := s.Claim("a"); !ok {
+		t.Error("event was still claimed after its TTL")
+	}
+
+	// Expired IDs are pruned by later claims
+	time.Sleep(20 * time.Millisecond)
+	s.Claim("b")
+
+	if _, ok := s.seen["a"]; ok {
+		t.Errorf("expired event is still stored: %v", s.seen)
+	}
+}
+
+// An event that fails is released, so that LINE's redelivery of it is handled
+func TestEventQueueReleasesFailedEvents(t *testing.T) {
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	s.respond("profile/U123", http.StatusOK, `{"displayName": "Tester"}`)
+	s.respond("message/reply", http.StatusInternalServerError, `{"message": "boom"}`)
+
+	q := NewEventQueue(1, 10, QueueFullReject)
+	q.Store = NewMemoryIdempotencyStore(time.Hour)
+
+	events := []*Event{
+		{Type: "follow", WebhookEventId: "failing", ReplyToken: "reply-token", Source: Source{Type: "user", UserId: "U123"}},
+		{Type: "unfollow", WebhookEventId: "handled", Source: Source{Type: "user", UserId: "U123"}},
+	}
+
+	if err := q.Enqueue(context.Background(), s.bot(t), events); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := q.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := q.Store.Claim("failing"); !ok {
+		t.Error("failed event is still claimed")
+	}
+
+	if ok, _ := q.Store.Claim("handled"); ok {
+		t.Error("handled event was released")
+	}
+}
@@ -1,12 +1,156 @@
 package main
 
-import ()
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sentinel errors that can be matched against an APIError with errors.Is
+var (
+	ErrRateLimited       = errors.New("rate limited by the LINE API")
+	ErrInvalidReplyToken = errors.New("invalid reply token")
+	ErrUnauthorized      = errors.New("channel access token was rejected")
+	ErrNotFound          = errors.New("resource not found")
+)
+
+// One entry of the details array in a LINE error response
+type APIErrorDetail struct {
+	Message  string `json:"message,omitempty"`
+	Property string `json:"property,omitempty"`
+}
 
 type APIError struct {
 	Code     int
 	Response string
+
+	// Parsed from the error response, if it was LINE's error JSON
+	Message string
+	Details []APIErrorDetail
+
+	// Value of the X-Line-Request-Id header, for contacting LINE about a failed request
+	RequestId string
+
+	// How long the server asked us to wait before retrying, if it sent a Retry-After header
+	RetryAfter time.Duration
+
+	// For 409 responses to retried requests, the ID of the request that was already accepted
+	AcceptedRequestId string
+}
+
+// Build an APIError from a non-200 response and its body
+func newAPIError(resp *http.Response, body []byte) *APIError {
+
+	apiErr := &APIError{
+		Code:              resp.StatusCode,
+		Response:          string(body),
+		RequestId:         resp.Header.Get("X-Line-Request-Id"),
+		RetryAfter:        parseRetryAfter(resp.Header.Get("Retry-After")),
+		AcceptedRequestId: resp.Header.Get("X-Line-Accepted-Request-Id"),
+	}
+
+	errorResponse := struct {
+		Message string           `json:"message"`
+		Details []APIErrorDetail `json:"details"`
+	}{}
+
+	// Not every error body is JSON (e.g. errors from proxies), so a parse failure is not an error here
+	if json.Unmarshal(body, &errorResponse) == nil {
+		apiErr.Message = errorResponse.Message
+		apiErr.Details = errorResponse.Details
+	}
+
+	return apiErr
 }
 
 func (e *APIError) Error() string {
-	return e.Response
+
+	if e.Message == "" {
+		return e.Response
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%d %s", e.Code, e.Message)
+
+	for i, detail := range e.Details {
+
+		if i == 0 {
+			b.WriteString(" (")
+		} else {
+			b.WriteString("; ")
+		}
+
+		if detail.Property != "" {
+			b.WriteString(detail.Property + ": ")
+		}
+
+		b.WriteString(detail.Message)
+	}
+
+	if len(e.Details) > 0 {
+		b.WriteString(")")
+	}
+
+	if e.RequestId != "" {
+		b.WriteString(" [request ID " + e.RequestId + "]")
+	}
+
+	return b.String()
+}
+
+// Lets errors.Is match the sentinel errors above
+func (e *APIError) Is(target error) bool {
+
+	switch target {
+	case ErrRateLimited:
+		return e.IsRateLimited()
+	case ErrInvalidReplyToken:
+		return e.IsInvalidReplyToken()
+	case ErrUnauthorized:
+		return e.Code == http.StatusUnauthorized
+	case ErrNotFound:
+		return e.Code == http.StatusNotFound
+	}
+
+	return false
+}
+
+func (e *APIError) IsRateLimited() bool {
+	return e.Code == http.StatusTooManyRequests
+}
+
+// Reply tokens can only be used once and expire shortly after the webhook is sent
+func (e *APIError) IsInvalidReplyToken() bool {
+	return e.Code == http.StatusBadRequest && strings.EqualFold(e.Message, "Invalid reply token")
+}
+
+// Returns true if sending the same request again may succeed
+func (e *APIError) IsRetryable() bool {
+	return e.IsRateLimited() || e.Code >= 500
+}
+
+// Parse a Retry-After header, which is either a number of seconds or an HTTP date
+func parseRetryAfter(value string) time.Duration {
+
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+
+		if delay := date.Sub(time.Now()); delay > 0 {
+			return delay
+		}
+	}
+
+	return 0
 }
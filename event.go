@@ -1,11 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
-	"math/rand"
-	"strings"
-	"time"
+	"fmt"
 )
 
 type Source struct {
@@ -15,120 +13,136 @@ type Source struct {
 	RoomId  string `json:"roomId,omitempty"`
 }
 
-type Postback struct {
-	Data string `json:"data,omitempty"`
-}
-
-type Event struct {
-	ReplyToken string          `json:"replyToken,omitempty"`
-	Type       string          `json:"type,omitempty"`
-	Timestamp  int64           `json:"timestamp,omitempty"`
-	Source     Source          `json:"source,omitempty"`
-	Message    json.RawMessage `json:"message,omitempty"`
-	Postback   Postback        `json:"postback,omitempty"`
-}
-
-// Function that handles postback events
-func ProcessPostbackEvent(e Event) error {
-
-	log.Println("Processing Postback Event")
-	log.Println("Postback Data: " + e.Postback.Data)
-
-	switch e.Postback.Data {
+// ID of the chat an event happened in: the user's ID in one-on-one chats, otherwise the group
+// or room ID
+func (s Source) chatId() string {
 
-	case "run":
+	switch s.Type {
+	case "group":
+		return s.GroupId
+	case "room":
+		return s.RoomId
+	}
 
-		rand.Seed((time.Now().UTC().UnixNano()))
+	return s.UserId
+}
 
-		coinFlip := rand.Intn(100000)
+type Postback struct {
+	Data   string         `json:"data,omitempty"`
+	Params PostbackParams `json:"params,omitempty"`
+}
 
-		log.Println("Coin flip number: ", coinFlip)
+// Members that joined or left a group or room
+type Members struct {
+	Members []Source `json:"members,omitempty"`
+}
 
-		if coinFlip%2 == 0 {
+// A user came near a beacon. Type is enter, banner or stay, and Dm is the hex encoded
+// message of the beacon's device.
+type Beacon struct {
+	Hwid string `json:"hwid,omitempty"`
+	Type string `json:"type,omitempty"`
+	Dm   string `json:"dm,omitempty"`
+}
 
-			replyMessage1 := ReplyMessage{
-				Text: "I got your run postback... and your were able to escape!!",
-				Type: "text",
-			}
+// The message that was unsent
+type Unsend struct {
+	MessageId string `json:"messageId,omitempty"`
+}
 
-			// TODO: Put this url in config file
-			image_url := os.Getenv("BOT_HOST") + "images/static/run.jpg"
-			preview_image_url := os.Getenv("BOT_HOST") + "images/static/p_run.jpg"
+type DeliveryContext struct {
+	IsRedelivery bool `json:"isRedelivery,omitempty"`
+}
 
-			replyMessage2 := ReplyMessage{
-				Type:               "image",
-				OriginalContentUrl: image_url,
-				PreviewImageUrl:    preview_image_url,
-			}
+type Event struct {
+	ReplyToken      string          `json:"replyToken,omitempty"`
+	Type            string          `json:"type,omitempty"`
+	Timestamp       int64           `json:"timestamp,omitempty"`
+	Source          Source          `json:"source,omitempty"`
+	Message         json.RawMessage `json:"message,omitempty"`
+	Postback        Postback        `json:"postback,omitempty"`
+	WebhookEventId  string          `json:"webhookEventId,omitempty"`
+	DeliveryContext DeliveryContext `json:"deliveryContext,omitempty"`
+	Joined          Members         `json:"joined,omitempty"`
+	Left            Members         `json:"left,omitempty"`
+	Unsend          Unsend          `json:"unsend,omitempty"`
+	Beacon          Beacon          `json:"beacon,omitempty"`
+}
 
-			err := SendReplyMessage(e.ReplyToken, []ReplyMessage{replyMessage1, replyMessage2})
+// Function that handles unsend events. Deletes everything stored for the message, so that
+// the user's retraction is respected.
+func ProcessUnsendEvent(ctx context.Context, b *Bot, e Event) error {
 
-			if err != nil {
-				return err
-			}
+	logger := loggerFrom(ctx)
 
-			return nil
+	logger.Info("Processing unsend event", "messageId", e.Unsend.MessageId)
 
-		} else {
+	deleted, err := DeleteMessageContent(e.Unsend.MessageId)
 
-			replyMessage1 := ReplyMessage{
-				Text: "I got your run postback... and the zombie got you! Now you must EXPLODE!",
-				Type: "text",
-			}
+	if err != nil {
+		return fmt.Errorf("failed to delete the content of the unsent message: %v", err)
+	}
 
-			// TODO: Put this url in config file
-			image_url := os.Getenv("BOT_HOST") + "images/static/explode.jpg"
-			preview_image_url := os.Getenv("BOT_HOST") + "images/static/p_explode.jpg"
+	if len(deleted) > 0 {
+		logger.Info("Deleted the content of the unsent message", "messageId", e.Unsend.MessageId, "files", deleted)
+	}
 
-			replyMessage2 := ReplyMessage{
-				Type:               "image",
-				OriginalContentUrl: image_url,
-				PreviewImageUrl:    preview_image_url,
-			}
+	return nil
+}
 
-			err := SendReplyMessage(e.ReplyToken, []ReplyMessage{replyMessage1, replyMessage2})
+// Function that handles postback events
+func ProcessPostbackEvent(ctx context.Context, b *Bot, e Event) error {
 
-			if err != nil {
-				return err
-			}
+	p, err := b.DecodePostback(e)
 
-			return nil
+	// Forged, copied or outdated postback data is not acted upon, but there is nothing to retry either
+	if err != nil {
+		loggerFrom(ctx).Warn("Ignoring postback with invalid data", "data", e.Postback.Data, "error", err)
+		return nil
+	}
 
-		}
+	loggerFrom(ctx).Info("Processing postback event", "action", p.Action, "params", e.Postback.Params)
 
-	case "noexplode":
+	if replies, ok := b.Scenario.postbackReplies(p.Action); ok {
 
-		replyMessage1 := ReplyMessage{
-			Text: "I got a postback saying that you do not want to explode... and I think you are a coward!",
-			Type: "text",
-		}
+		vars := e.Postback.Params.variables()
 
-		replyMessage2 := ReplyMessage{
-			Type:      "sticker",
-			StickerId: "527",
-			PackageId: "2",
+		for name := range p.Params {
+			vars[name] = p.Params.Get(name)
 		}
 
-		err := SendReplyMessage(e.ReplyToken, []ReplyMessage{replyMessage1, replyMessage2})
+		vars["data"] = e.Postback.Data
+		vars["action"] = p.Action
 
-		if err != nil {
-			return err
-		}
+		return b.replyWithScenario(ctx, e, replies, vars)
+	}
 
-		return nil
+	found, err := b.Postbacks.Dispatch(ctx, b, e, p)
 
+	if !found {
+		loggerFrom(ctx).Warn("No handler for postback", "action", p.Action)
 	}
 
-	return nil
+	return err
 }
 
 // Function to handle follow events
-func ProcessFollowEvent(e Event) error {
+func ProcessFollowEvent(ctx context.Context, b *Bot, e Event) error {
+
+	loggerFrom(ctx).Info("Processing follow event")
+
+	if replies, ok := b.Scenario.eventReplies("follow"); ok {
+		return b.replyWithScenario(ctx, e, replies, nil)
+	}
+
+	profile, err := b.Client.GetProfile(ctx, e.Source.UserId)
 
-	log.Println("Processing Follow Event")
+	if err != nil {
+		return err
+	}
 
 	replyMessage1 := ReplyMessage{
-		Text: "Hi, " + GetProfile(e.Source.GroupId).DisplayName + "!!",
+		Text: "Hi, " + profile.DisplayName + "!!",
 		Type: "text",
 	}
 
@@ -143,7 +157,7 @@ func ProcessFollowEvent(e Event) error {
 		PackageId: "2",
 	}
 
-	err := SendReplyMessage(e.ReplyToken, []ReplyMessage{replyMessage1, replyMessage2, replyMessage3})
+	err = b.Client.SendReplyMessage(ctx, e.ReplyToken, []ReplyMessage{replyMessage1, replyMessage2, replyMessage3})
 
 	if err != nil {
 		return err
@@ -154,9 +168,13 @@ func ProcessFollowEvent(e Event) error {
 }
 
 // Function to handle follow events
-func ProcessJoinEvent(e Event) error {
+func ProcessJoinEvent(ctx context.Context, b *Bot, e Event) error {
 
-	log.Println("Processing Join Event")
+	loggerFrom(ctx).Info("Processing join event")
+
+	if replies, ok := b.Scenario.eventReplies("join"); ok {
+		return b.replyWithScenario(ctx, e, replies, nil)
+	}
 
 	replyMessage1 := ReplyMessage{
 		Text: "Hello everybody!",
@@ -174,7 +192,7 @@ func ProcessJoinEvent(e Event) error {
 		PackageId: "2",
 	}
 
-	err := SendReplyMessage(e.ReplyToken, []ReplyMessage{replyMessage1, replyMessage2, replyMessage3})
+	err := b.Client.SendReplyMessage(ctx, e.ReplyToken, []ReplyMessage{replyMessage1, replyMessage2, replyMessage3})
 
 	if err != nil {
 		return err
@@ -185,282 +203,37 @@ func ProcessJoinEvent(e Event) error {
 }
 
 // Function to handle follow events
-func ProcessUnfollowEvent(e Event) {
+func ProcessUnfollowEvent(ctx context.Context, b *Bot, e Event) {
 
-	log.Println("Bot has been unfollowed by user: " + e.Source.UserId)
+	loggerFrom(ctx).Info("Bot has been unfollowed", "userId", e.Source.UserId)
 
 }
 
 // Function to handle follow events
-func ProcessLeaveEvent(e Event) {
+func ProcessLeaveEvent(ctx context.Context, b *Bot, e Event) {
 
-	log.Println("Bot has left group: " + e.Source.GroupId)
+	loggerFrom(ctx).Info("Bot has left group", "groupId", e.Source.GroupId)
 
 }
 
 // Function to handle all message events
-func ProcessMessageEvent(e Event) error {
+func ProcessMessageEvent(ctx context.Context, b *Bot, e Event) error {
 
 	var m Message
 
-	log.Println("Entered ProcessMessageEvent")
-
 	err := json.Unmarshal(e.Message, &m)
 
-	log.Println("Finished Unmarshall")
-
 	if err != nil {
-		log.Fatalln("error unmarshalling message: ", err)
-	}
-
-	log.Println("Message Information is as follows: ")
-	log.Println("Id: " + m.Id)
-	log.Println("Type: " + m.Type)
-	log.Println("Text: " + m.Text)
-	log.Println("PackageId: " + m.PackageId)
-	log.Println("StickerId: " + m.StickerId)
-	log.Println("Title: " + m.Title)
-	log.Println("Address: " + m.Address)
-	log.Println("Latitude: ", m.Latitude)
-	log.Println("Longitude: ", m.Longitude)
-
-	// Image Map
-	if strings.Contains(strings.ToLower(m.Text), "imagemap") {
-
-		err := SendImageMap(e.ReplyToken)
-
-		if err != nil {
-			return err
-		}
-
-		return nil
-
-	}
-
-	// Leave API
-	if strings.Contains(strings.ToLower(m.Text), "goodbye") {
-
-		var err error
-
-		switch e.Source.Type {
-
-		case "room":
-
-			err = LeaveGroupOrRoom(e.Source.Type, e.Source.RoomId)
-
-		case "group":
-
-			err = LeaveGroupOrRoom(e.Source.Type, e.Source.GroupId)
-
-		default:
-
-			err = &APIError{
-				Code:     500,
-				Response: "Invalid Source Type",
-			}
-
-		}
-
-		if err != nil {
-			return err
-		} else {
-			return nil
-		}
-	}
-
-	// Push Message API
-	if strings.Contains(strings.ToLower(m.Text), "push") {
-
-		message1 := ReplyMessage{
-			Type: "text",
-			Text: "This is a PUSH Message! I am not using your reply token at all.",
-		}
-
-		message2 := ReplyMessage{
-			Type:      "sticker",
-			StickerId: "19",
-			PackageId: "2",
-		}
-
-		var toId string = e.Source.UserId
-
-		switch e.Source.Type {
-
-		case "group":
-			toId = e.Source.GroupId
-		case "room":
-			toId = e.Source.RoomId
-
-		}
-
-		SendPushMessage([]ReplyMessage{message1, message2}, toId)
-
-	}
-
-	// Confirm Dialog API
-	if strings.Contains(strings.ToLower(m.Text), "explode") {
-
-		log.Println("Processing explode event")
-
-		templateAction1 := TemplateAction{
-			Type:  "uri",
-			Label: "YES!",
-			Uri:   "https://line-bot-test-app-v2.herokuapp.com/images/static/explode.jpg",
-		}
-
-		templateAction2 := TemplateAction{
-			Type:  "postback",
-			Label: "NO!",
-			Data:  "noexplode",
-		}
-
-		templateActions := []TemplateAction{templateAction1, templateAction2}
-
-		template := Template{
-			Type:    "confirm",
-			Text:    "Are you SURE you want to explode?",
-			Actions: templateActions,
-		}
-
-		confirmMessage := ReplyMessage{
-			AltText:  "This is a confirm template",
-			Type:     "template",
-			Template: template,
-		}
-
-		err := SendReplyMessage(e.ReplyToken, []ReplyMessage{confirmMessage})
-
-		if err != nil {
-			return err
-		}
-
-		return nil
-
-	}
-
-	// Buttons Dialog API
-	if strings.Contains(strings.ToLower(m.Text), "find zombie") {
-
-		log.Println("Processing zombie event")
-
-		templateAction1 := TemplateAction{
-			Type:  "postback",
-			Label: "Run!",
-			Data:  "run",
-			Text:  "I'm outta here!!",
-		}
-
-		templateAction2 := TemplateAction{
-			Type:  "message",
-			Label: "Scream!",
-			Text:  "AHHHHHH!",
-		}
-
-		templateAction3 := TemplateAction{
-			Type:  "uri",
-			Label: "EXPLODE!",
-			Uri:   "https://line-bot-test-app-v2.herokuapp.com/images/static/explode.jpg",
-		}
-
-		templateActions := []TemplateAction{templateAction1, templateAction2, templateAction3}
-
-		template := Template{
-			Type:              "buttons",
-			ThumbnailImageUrl: "https://line-bot-test-app-v2.herokuapp.com/images/static/zombiemessage.jpg",
-			Title:             "You have encountered a ZOMBIE!!",
-			Text:              "What do you do?!?",
-			Actions:           templateActions,
-		}
-
-		buttonMessage := ReplyMessage{
-			AltText:  "This is a buttons template",
-			Type:     "template",
-			Template: template,
-		}
-
-		err := SendReplyMessage(e.ReplyToken, []ReplyMessage{buttonMessage})
-
-		if err != nil {
-			return err
-		}
-
-		return nil
-
+		return fmt.Errorf("failed to unmarshal message: %v", err)
 	}
 
-	// Carousel Dialog API
-	if strings.Contains(strings.ToLower(m.Text), "multizombie") {
-
-		log.Println("Processing Multizombie Event")
-
-		templateAction1 := TemplateAction{
-			Type:  "postback",
-			Label: "Run!",
-			Data:  "run",
-			Text:  "I'm outta here!!",
-		}
-
-		templateAction2 := TemplateAction{
-			Type:  "message",
-			Label: "Scream!",
-			Text:  "AHHHHHH!",
-		}
-
-		templateAction3 := TemplateAction{
-			Type:  "uri",
-			Label: "EXPLODE!",
-			Uri:   "https://line-bot-test-app-v2.herokuapp.com/images/static/explode.jpg",
-		}
-
-		templateActions := []TemplateAction{templateAction1, templateAction2, templateAction3}
-
-		column1 := Column{
-			ThumbnailImageUrl: "https://line-bot-test-app-v2.herokuapp.com/images/static/zombiemessage.jpg",
-			Title:             "Zombie 1",
-			Text:              "You have encoutered Zombie 1!",
-			Actions:           templateActions,
-		}
-
-		column2 := Column{
-			ThumbnailImageUrl: "https://line-bot-test-app-v2.herokuapp.com/images/static/zombiemessage.jpg",
-			Title:             "Zombie 2",
-			Text:              "You have encoutered Zombie 2!",
-			Actions:           templateActions,
-		}
-
-		column3 := Column{
-			ThumbnailImageUrl: "https://line-bot-test-app-v2.herokuapp.com/images/static/zombiemessage.jpg",
-			Title:             "Zombie 3",
-			Text:              "You have encoutered Zombie 3!",
-			Actions:           templateActions,
-		}
-
-		//Declare Columns Array
-		columns := []Column{column1, column2, column3}
-
-		template := Template{
-			Type:              "carousel",
-			ThumbnailImageUrl: "https://line-bot-test-app-v2.herokuapp.com/images/static/zombiemessage.jpg",
-			Title:             "You have encountered a ZOMBIE!!",
-			Text:              "What do you do?!?",
-			Actions:           templateActions,
-			Columns:           columns,
-		}
-
-		carouselMessage := ReplyMessage{
-			AltText:  "This is a Carousel template",
-			Type:     "template",
-			Template: template,
-		}
+	loggerFrom(ctx).Info("Processing message event", "messageId", m.Id, "messageType", m.Type, "text", m.Text)
+	loggerFrom(ctx).Debug("Message details", "message", m)
 
-		err := SendReplyMessage(e.ReplyToken, []ReplyMessage{carouselMessage})
-
-		if err != nil {
-			return err
-		}
-
-		return nil
+	_, err = b.Commands.Dispatch(ctx, b, e, m)
 
+	if err != nil {
+		return err
 	}
 
 	//	ReplyToMessage(e.ReplyToken, m)
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const defaultEventWorkers int = 4
+const defaultEventQueueDepth int = 100
+
+// Deadline for handling a single event, including all the API calls it makes
+const eventTimeout time.Duration = time.Minute
+
+var ErrEventQueueFull = errors.New("event queue is full")
+var ErrEventQueueClosed = errors.New("event queue is shutting down")
+
+// What happens to a webhook when the event queue doesn't have room for its events
+const (
+	// Reject the whole webhook with 503, so that LINE can redeliver it
+	QueueFullReject = "reject"
+	// Wait for room until the webhook request is cancelled
+	QueueFullBlock = "block"
+	// Accept the webhook and drop the events that don't fit
+	QueueFullDrop = "drop"
+)
+
+type queuedEvent struct {
+	bot    *Bot
+	event  Event
+	batch  *webhookBatch
+	logger *Logger
+
+	// Span of the webhook the event arrived in, and when it was queued
+	parent   *Span
+	queuedAt time.Time
+}
+
+// A bounded queue of webhook events that are handled by a pool of workers, so that webhooks can
+// be acknowledged before their events are processed.
+type EventQueue struct {
+	queueFull string
+
+	// Used to skip events that were already queued. Nil disables deduplication.
+	Store IdempotencyStore
+
+	// Where events that could not be handled are written. Nil only logs them.
+	DeadLetters *DeadLetterLog
+
+	events chan queuedEvent
+	wg     sync.WaitGroup
+
+	// Cancelled if the queue can't be drained in time on shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Enqueue registers its senders under mu, so that Shutdown can wait for them before it closes
+	// the events channel. Senders don't hold it while they send.
+	mu      sync.Mutex
+	closed  bool
+	closing chan struct{}
+	senders sync.WaitGroup
+
+	// Held while checking the free space and queueing a webhook in reject mode
+	reserve sync.Mutex
+}
+
+// Create a queue and start its workers
+func NewEventQueue(workers int, depth int, queueFull string) *EventQueue {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	q := &EventQueue{
+		queueFull: queueFull,
+		events:    make(chan queuedEvent, depth),
+		closing:   make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+
+	for i := 0; i < workers; i++ {
+
+		q.wg.Add(1)
+		go q.work()
+	}
+
+	return q
+}
+
+func (q *EventQueue) work() {
+
+	defer q.wg.Done()
+
+	for qe := range q.events {
+		q.handle(qe)
+	}
+}
+
+func (q *EventQueue) handle(qe queuedEvent) {
+
+	if qe.event.DeliveryContext.IsRedelivery {
+		qe.logger.Info("Handling redelivered event")
+	}
+
+	// Failed events of an unsent message may still hold its text
+	if qe.event.Type == "unsend" {
+		q.scrub(qe)
+	}
+
+	err := q.process(qe)
+
+	// An invalid reply token will not become valid by trying again
+	if errors.Is(err, ErrInvalidReplyToken) {
+		qe.logger.Warn("Could not reply to event, the reply token is invalid or has expired", "error", err)
+		q.finish(qe, nil)
+		return
+	}
+
+	if err != nil {
+		q.fail(qe, err)
+		return
+	}
+
+	q.finish(qe, nil)
+}
+
+// Handle a single event, turning a panic into an error so that it doesn't take down the other events
+func (q *EventQueue) process(qe queuedEvent) (err error) {
+
+	ctx, cancel := context.WithTimeout(withLogger(withSpan(q.ctx, qe.parent), qe.logger), eventTimeout)
+	defer cancel()
+
+	ctx, span := startSpan(ctx, "event", SpanKindInternal,
+		"eventType", qe.event.Type,
+		"webhookEventId", qe.event.WebhookEventId,
+		"redelivery", qe.event.DeliveryContext.IsRedelivery,
+		"queuedMs", float64(time.Since(qe.queuedAt))/float64(time.Millisecond),
+	)
+
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	defer func() {
+
+		if r := recover(); r != nil {
+			qe.logger.Error("Panic while processing event", "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return ProcessEvent(ctx, qe.bot, qe.event)
+}
+
+// Record an event that could not be handled in the dead-letter log
+func (q *EventQueue) fail(qe queuedEvent, err error) {
+
+	qe.logger.Error("Failed to process event", "error", err)
+
+	if q.DeadLetters != nil {
+
+		if dlErr := q.DeadLetters.Write(qe.bot.Config.ChannelId, qe.event, err); dlErr != nil {
+			qe.logger.Error("Failed to write event to the dead-letter log", "error", dlErr)
+		}
+	}
+
+	// Let a redelivery of the event try again
+	q.release([]queuedEvent{qe})
+
+	q.finish(qe, err)
+}
+
+// Remove the events of an unsent message from the dead-letter log
+func (q *EventQueue) scrub(qe queuedEvent) {
+
+	if q.DeadLetters == nil || qe.event.Unsend.MessageId == "" {
+		return
+	}
+
+	removed, err := q.DeadLetters.Scrub(qe.event.Unsend.MessageId)
+
+	if err != nil {
+		qe.logger.Error("Failed to scrub the unsent message from the dead-letter log", "messageId", qe.event.Unsend.MessageId, "error", err)
+		return
+	}
+
+	if removed > 0 {
+		qe.logger.Info("Scrubbed the unsent message from the dead-letter log", "messageId", qe.event.Unsend.MessageId, "entries", removed)
+	}
+}
+
+// Report the failures of a webhook's events once the last of them is done
+func (q *EventQueue) finish(qe queuedEvent, err error) {
+
+	if qe.batch == nil {
+		return
+	}
+
+	if failures := qe.batch.done(qe.event, err); failures != nil {
+		qe.batch.logger.Warn("Some events of the webhook failed", "failed", len(failures), "total", qe.batch.total, "errors", failures)
+	}
+}
+
+// Claim the events in the idempotency store and return the ones that were not seen before
+func (q *EventQueue) claim(logger *Logger, b *Bot, events []*Event) []queuedEvent {
+
+	claimed := make([]queuedEvent, 0, len(events))
+
+	for _, event := range events {
+
+		if event == nil {
+			continue
+		}
+
+		// Events without a webhook event ID get a generated one for the logs
+		eventId := event.WebhookEventId
+
+		if eventId == "" {
+			eventId, _ = newUUID()
+		}
+
+		eventLogger := logger.With("eventId", eventId, "eventType", event.Type)
+
+		if q.Store != nil && event.WebhookEventId != "" {
+
+			ok, err := q.Store.Claim(event.WebhookEventId)
+
+			// If the store can't be reached, handling an event twice is better than not at all
+			if err != nil {
+				eventLogger.Warn("Failed to check webhook event ID", "error", err)
+			} else if !ok {
+				eventLogger.Info("Skipping event, it was already processed", "redelivery", event.DeliveryContext.IsRedelivery)
+				continue
+			}
+		}
+
+		claimed = append(claimed, queuedEvent{bot: b, event: *event, logger: eventLogger})
+	}
+
+	return claimed
+}
+
+// Release events that were claimed but not handled
+func (q *EventQueue) release(events []queuedEvent) {
+
+	if q.Store == nil {
+		return
+	}
+
+	for _, qe := range events {
+
+		if qe.event.WebhookEventId == "" {
+			continue
+		}
+
+		if err := q.Store.Release(qe.event.WebhookEventId); err != nil {
+			qe.logger.Warn("Failed to release webhook event ID", "error", err)
+		}
+	}
+}
+
+// Queue the events of a webhook. Returns ErrEventQueueFull if they can't be queued, depending
+// on the queue's back-pressure behaviour.
+func (q *EventQueue) Enqueue(ctx context.Context, b *Bot, events []*Event) error {
+
+	q.mu.Lock()
+
+	if q.closed {
+		q.mu.Unlock()
+		return ErrEventQueueClosed
+	}
+
+	q.senders.Add(1)
+	q.mu.Unlock()
+
+	defer q.senders.Done()
+
+	logger := loggerFrom(ctx)
+	claimed := q.claim(logger, b, events)
+	batch := newWebhookBatch(logger, len(claimed))
+
+	parent := spanFromContext(ctx)
+
+	for i := range claimed {
+		claimed[i].batch = batch
+		claimed[i].parent = parent
+		claimed[i].queuedAt = time.Now()
+	}
+
+	switch q.queueFull {
+
+	case QueueFullReject:
+
+		return q.enqueueOrReject(logger, claimed)
+
+	case QueueFullBlock:
+
+		return q.enqueueBlocking(ctx, logger, claimed)
+
+	default:
+
+		q.enqueueOrDrop(logger, claimed)
+		return nil
+	}
+}
+
+// Queue all of the events, or none of them if the queue doesn't have room. A webhook with more
+// events than the queue can ever hold is queued partially once the queue is empty, as it would
+// otherwise be rejected on every redelivery.
+func (q *EventQueue) enqueueOrReject(logger *Logger, claimed []queuedEvent) error {
+
+	// Only the workers take events out of the queue while the lock is held, so checking the free
+	// space up front guarantees that either all of the events are queued or none of them are
+	q.reserve.Lock()
+	defer q.reserve.Unlock()
+
+	free := cap(q.events) - len(q.events)
+
+	if len(claimed) > free && free < cap(q.events) {
+		q.release(claimed)
+		return ErrEventQueueFull
+	}
+
+	q.enqueueOrDrop(logger, claimed)
+
+	return nil
+}
+
+// Queue the events, waiting for room until the webhook request is cancelled or the queue shuts down
+func (q *EventQueue) enqueueBlocking(ctx context.Context, logger *Logger, claimed []queuedEvent) error {
+
+	for i, qe := range claimed {
+
+		select {
+
+		case q.events <- qe:
+
+		case <-ctx.Done():
+
+			logger.Warn("Gave up queueing events", "notQueued", len(claimed)-i, "total", len(claimed))
+			q.release(claimed[i:])
+
+			return ErrEventQueueFull
+
+		case <-q.closing:
+
+			logger.Warn("Event queue is shutting down, not queueing events", "notQueued", len(claimed)-i, "total", len(claimed))
+			q.release(claimed[i:])
+
+			return ErrEventQueueClosed
+		}
+	}
+
+	return nil
+}
+
+// Queue the events that fit and drop the rest
+func (q *EventQueue) enqueueOrDrop(logger *Logger, claimed []queuedEvent) {
+
+	for i, qe := range claimed {
+
+		select {
+		case q.events <- qe:
+		default:
+			logger.Warn("Event queue is full, dropping events", "dropped", len(claimed)-i, "total", len(claimed))
+
+			for _, dropped := range claimed[i:] {
+				q.fail(dropped, ErrEventQueueFull)
+			}
+
+			return
+		}
+	}
+}
+
+// Number of events waiting to be handled, and how many the queue can hold
+func (q *EventQueue) Len() (int, int) {
+	return len(q.events), cap(q.events)
+}
+
+// Stop accepting events and wait for the queued ones to be handled. If the context is done
+// first, the events that are still being handled are cancelled.
+func (q *EventQueue) Shutdown(ctx context.Context) error {
+
+	q.mu.Lock()
+
+	if !q.closed {
+
+		q.closed = true
+		q.mu.Unlock()
+
+		// Blocked senders give up, and no one sends once they are done
+		close(q.closing)
+		q.senders.Wait()
+		close(q.events)
+
+	} else {
+		q.mu.Unlock()
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+
+	case <-done:
+
+		return nil
+
+	case <-ctx.Done():
+
+		q.cancel()
+		<-done
+
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func queueTestEvents(ids ...string) []*Event {
+
+	events := make([]*Event, 0, len(ids))
+
+	for _, id := range ids {
+		events = append(events, &Event{Type: "message", WebhookEventId: id})
+	}
+
+	return events
+}
+
+// Take the queued events out of a queue without workers
+func drainQueue(q *EventQueue) []string {
+
+	var ids []string
+
+	for {
+		select {
+		case qe := <-q.events:
+			ids = append(ids, qe.event.WebhookEventId)
+		default:
+			return ids
+		}
+	}
+}
+
+func TestEventQueueEnqueue(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		queueFull string
+
+		// Events already waiting in a queue of depth 2, and the events of the webhook
+		queued  int
+		events  int
+		wantErr error
+
+		// Events of the webhook that end up in the queue
+		wantQueued int
+	}{
+		{name: "reject with room", queueFull: QueueFullReject, events: 2, wantQueued: 2},
+		{name: "reject without room", queueFull: QueueFullReject, queued: 1, events: 2, wantErr: ErrEventQueueFull},
+		{name: "reject larger than the queue", queueFull: QueueFullReject, events: 3, wantQueued: 2},
+		{name: "reject larger than a busy queue", queueFull: QueueFullReject, queued: 1, events: 3, wantErr: ErrEventQueueFull},
+		{name: "drop", queueFull: QueueFullDrop, queued: 1, events: 2, wantQueued: 1},
+		{name: "block with room", queueFull: QueueFullBlock, events: 2, wantQueued: 2},
+		{name: "block until cancelled", queueFull: QueueFullBlock, queued: 1, events: 2, wantErr: ErrEventQueueFull, wantQueued: 1},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			q := NewEventQueue(0, 2, tt.queueFull)
+			q.Store = NewMemoryIdempotencyStore(time.Hour)
+
+			for i := 0; i < tt.queued; i++ {
+				q.events <- queuedEvent{event: Event{WebhookEventId: fmt.Sprint("queued-", i)}}
+			}
+
+			ids := make([]string, tt.events)
+
+			for i := range ids {
+				ids[i] = fmt.Sprint("event-", i)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+
+			if err := q.Enqueue(ctx, nil, queueTestEvents(ids...)); err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+
+			queued := drainQueue(q)[tt.queued:]
+
+			if len(queued) != tt.wantQueued {
+				t.Fatalf("queued %v, want %d events", queued, tt.wantQueued)
+			}
+
+			// Events that were not queued are released, so that a redelivery can handle them
+			for _, id := range ids[len(queued):] {
+
+				ok, _ := q.Store.Claim(id)
+
+				if !ok {
+					t.Errorf("%s was not released", id)
+				}
+			}
+		})
+	}
+}
+
+func TestEventQueueSkipsClaimedEvents(t *testing.T) {
+
+	q := NewEventQueue(0, 10, QueueFullReject)
+	q.Store = NewMemoryIdempotencyStore(time.Hour)
+
+	if err := q.Enqueue(context.Background(), nil, queueTestEvents("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Enqueue(context.Background(), nil, queueTestEvents("b", "c")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := drainQueue(q); fmt.Sprint(got) != "[a b c]" {
+		t.Errorf("queued %v, want [a b c]", got)
+	}
+}
+
+func TestEventQueueBlockedSenderDoesNotBlockOthers(t *testing.T) {
+
+	q := NewEventQueue(0, 1, QueueFullBlock)
+
+	q.events <- queuedEvent{}
+
+	blocked := make(chan error, 1)
+
+	go func() {
+		blocked <- q.Enqueue(context.Background(), nil, queueTestEvents("a"))
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	// Other webhooks can still give up on their own
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := q.Enqueue(ctx, nil, queueTestEvents("b")); err != ErrEventQueueFull {
+		t.Errorf("err = %v, want ErrEventQueueFull", err)
+	}
+
+	// And shutting down makes the blocked sender give up
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Second)
+	defer shutdownCancel()
+
+	if err := q.Shutdown(shutdownCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-blocked:
+		if err != ErrEventQueueClosed {
+			t.Errorf("blocked sender err = %v, want ErrEventQueueClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked sender didn't give up")
+	}
+
+	if err := q.Enqueue(context.Background(), nil, queueTestEvents("c")); err != ErrEventQueueClosed {
+		t.Errorf("err after shutdown = %v, want ErrEventQueueClosed", err)
+	}
+}
+
+// A panicking handler fails only its own event
+func TestEventQueueRecoversPanics(t *testing.T) {
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	b := s.bot(t)
+
+	b.Commands.Register(Command{
+		Name:    "panic",
+		Trigger: TriggerExact,
+		Pattern: "panic",
+		Handler: func(ctx context.Context, b *Bot, e Event, m Message) error {
+			panic("handler is broken")
+		},
+	})
+
+	dir, err := ioutil.TempDir("", "deadletters")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dead_letters.jsonl")
+
+	// One worker, so that the second event is handled by the worker that recovered
+	q := NewEventQueue(1, 10, QueueFullReject)
+	q.DeadLetters = NewDeadLetterLog(path, rootLogger)
+
+	message := func(id string, text string) *Event {
+
+		return &Event{
+			Type:           "message",
+			WebhookEventId: id,
+			ReplyToken:     "reply-token",
+			Source:         Source{Type: "user", UserId: "U123"},
+			Message:        json.RawMessage(`{"id": "` + id + `", "type": "text", "text": "` + text + `"}`),
+		}
+	}
+
+	if err := q.Enqueue(context.Background(), b, []*Event{message("1", "panic"), message("2", "help")}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := q.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+
+	if len(lines) != 1 || !strings.Contains(lines[0], `"error":"panic: handler is broken"`) || !strings.Contains(lines[0], `"id":"1"`) {
+		t.Errorf("dead letters = %s, want the panicking event", content)
+	}
+
+	if replies := s.replies(t); len(replies) != 1 || !strings.HasPrefix(replies[0][0].Text, "Here is what I can do") {
+		t.Errorf("replies = %+v, want the help reply", replies)
+	}
+}
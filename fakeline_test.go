@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+
+	// Keep the test output readable
+	rootLogger = NewLogger(ioutil.Discard, LevelDebug, defaultRedactions)
+
+	os.Exit(m.Run())
+}
+
+// A request received by the fake LINE server
+type fakeRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// Decode the JSON body of the request into v
+func (r fakeRequest) decode(t *testing.T, v interface{}) {
+
+	t.Helper()
+
+	if err := json.Unmarshal(r.Body, v); err != nil {
+		t.Fatalf("%s %s: invalid JSON body %s: %v", r.Method, r.Path, r.Body, err)
+	}
+}
+
+// A fake Messaging API, so that the client and the handlers can be tested without calling
+// api.line.me. It records every request and answers 200 with {} unless a handler is set for the path.
+type fakeLINEServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []fakeRequest
+	handlers map[string]http.HandlerFunc
+}
+
+// The caller has to Close the server
+func newFakeLINEServer() *fakeLINEServer {
+
+	s := &fakeLINEServer{handlers: make(map[string]http.HandlerFunc)}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		body, _ := ioutil.ReadAll(r.Body)
+
+		path := strings.TrimPrefix(r.URL.Path, "/v2/bot/")
+
+		s.mu.Lock()
+		s.requests = append(s.requests, fakeRequest{Method: r.Method, Path: path, Header: r.Header, Body: body})
+		handler, ok := s.handlers[path]
+		s.mu.Unlock()
+
+		w.Header().Set("X-Line-Request-Id", "test-request-id")
+
+		if ok {
+			handler(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+
+	return s
+}
+
+// Answer requests for the path (relative to /v2/bot/) with the handler
+func (s *fakeLINEServer) handle(path string, handler http.HandlerFunc) {
+
+	s.mu.Lock()
+	s.handlers[path] = handler
+	s.mu.Unlock()
+}
+
+// Answer requests for the path with the status code and JSON body
+func (s *fakeLINEServer) respond(path string, code int, body string) {
+
+	s.handle(path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		w.Write([]byte(body))
+	})
+}
+
+func (s *fakeLINEServer) Requests() []fakeRequest {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]fakeRequest(nil), s.requests...)
+}
+
+// The requests made to the path
+func (s *fakeLINEServer) RequestsTo(path string) []fakeRequest {
+
+	var requests []fakeRequest
+
+	for _, r := range s.Requests() {
+
+		if r.Path == path {
+			requests = append(requests, r)
+		}
+	}
+
+	return requests
+}
+
+// A client of the fake server that doesn't wait between retries
+func (s *fakeLINEServer) client() *Client {
+
+	c := NewClient(s.URL+"/v2/bot/", "test-token", s.Client(), nil)
+	c.RetryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	return c
+}
+
+// Config of a bot under test
+func testConfig() *Config {
+
+	return &Config{
+		BotHost:            "https://bot.example/",
+		StaticAssetsUrl:    "https://bot.example/images/static/",
+		ChannelSecret:      "test-secret",
+		ChannelAccessToken: "test-token",
+		PostbackSecret:     "test-secret",
+		MaxStoredImages:    30,
+		TimeZone:           time.UTC,
+	}
+}
+
+// A bot without a scenario that talks to the fake server
+func (s *fakeLINEServer) bot(t *testing.T) *Bot {
+
+	t.Helper()
+
+	b, err := NewBot(testConfig(), s.client(), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// The messages of the replies sent to the fake server
+func (s *fakeLINEServer) replies(t *testing.T) [][]ReplyMessage {
+
+	t.Helper()
+
+	var replies [][]ReplyMessage
+
+	for _, r := range s.RequestsTo("message/reply") {
+
+		var reply struct {
+			Messages []ReplyMessage `json:"messages"`
+		}
+
+		r.decode(t, &reply)
+		replies = append(replies, reply.Messages)
+	}
+
+	return replies
+}
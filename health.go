@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Set when building, e.g. go build -ldflags "-X main.gitCommit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+var gitCommit = "unknown"
+var buildTime = "unknown"
+
+// How long the result of checking a channel's access token is reused, so that frequent
+// readiness probes don't turn into frequent LINE API calls
+const tokenCheckInterval time.Duration = 30 * time.Second
+
+const tokenCheckTimeout time.Duration = 5 * time.Second
+
+type tokenCheck struct {
+	checked time.Time
+	err     error
+}
+
+// Serves the health, readiness and version endpoints
+type HealthChecker struct {
+	reloader *Reloader
+	queue    *EventQueue
+
+	mu          sync.Mutex
+	tokenChecks map[*Client]tokenCheck
+}
+
+func NewHealthChecker(reloader *Reloader, queue *EventQueue) *HealthChecker {
+
+	return &HealthChecker{
+		reloader:    reloader,
+		queue:       queue,
+		tokenChecks: make(map[*Client]tokenCheck),
+	}
+}
+
+// The process is up and serving requests
+func (h *HealthChecker) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// The bot can handle webhooks: a valid config is active, LINE accepts its access tokens, it can store
+// content and its event queue has room
+func (h *HealthChecker) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+
+	checks := make(map[string]string)
+	ready := true
+
+	check := func(name string, err error) {
+
+		if err != nil {
+			checks[name] = err.Error()
+			ready = false
+			return
+		}
+
+		checks[name] = "ok"
+	}
+
+	// A failed reload leaves the previous config active, so it is only reported
+	bots := h.reloader.Bots()
+
+	if len(bots) == 0 {
+		check("config", errors.New("no valid configuration is loaded"))
+	} else if err := h.reloader.LastError(); err != nil {
+		checks["config"] = "last reload failed, serving the previous configuration: " + err.Error()
+	} else {
+		check("config", nil)
+	}
+
+	for channelId, b := range bots {
+
+		name := "token"
+
+		if channelId != "" {
+			name = "token:" + channelId
+		}
+
+		check(name, h.checkToken(r.Context(), b.Client))
+	}
+
+	check("images", checkWritable(imageDirectory))
+
+	depth, capacity := h.queue.Len()
+
+	if depth >= capacity {
+		check("queue", fmt.Errorf("queue is full (%d/%d)", depth, capacity))
+	} else {
+		check("queue", nil)
+	}
+
+	status := "ok"
+	code := http.StatusOK
+
+	if !ready {
+		status = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, code, map[string]interface{}{"status": status, "checks": checks})
+}
+
+// The build and the environment of every channel that is served
+func (h *HealthChecker) VersionHandler(w http.ResponseWriter, r *http.Request) {
+
+	environments := make(map[string]string)
+
+	for channelId, b := range h.reloader.Bots() {
+
+		environment := "beta"
+
+		if b.Config.UseRealEnvironment {
+			environment = "real"
+		}
+
+		if channelId == "" {
+			channelId = "default"
+		}
+
+		environments[channelId] = environment
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"commit":       gitCommit,
+		"buildTime":    buildTime,
+		"environments": environments,
+	})
+}
+
+// Check that LINE (or the fake endpoint) accepts the client's access token, reusing a recent result
+func (h *HealthChecker) checkToken(ctx context.Context, c *Client) error {
+
+	h.mu.Lock()
+	previous, ok := h.tokenChecks[c]
+	h.mu.Unlock()
+
+	if ok && time.Since(previous.checked) < tokenCheckInterval {
+		return previous.err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tokenCheckTimeout)
+	defer cancel()
+
+	_, err := c.GetBotInfo(ctx)
+
+	h.mu.Lock()
+	h.tokenChecks[c] = tokenCheck{checked: time.Now(), err: err}
+	h.mu.Unlock()
+
+	return err
+}
+
+// Check that files can be created in the directory
+func checkWritable(dir string) error {
+
+	file, err := ioutil.TempFile(dir, ".readyz")
+
+	if err != nil {
+		return err
+	}
+
+	file.Close()
+
+	return os.Remove(file.Name())
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	json.NewEncoder(w).Encode(v)
+}
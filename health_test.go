@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadyzAfterFailedReload(t *testing.T) {
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	b := s.bot(t)
+	loadErr := error(nil)
+
+	reloader, err := NewReloader(func() (Bots, error) {
+
+		if loadErr != nil {
+			return nil, loadErr
+		}
+
+		return Bots{"": b}, nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHealthChecker(reloader, NewEventQueue(0, 10, QueueFullReject))
+
+	readyz := func() (int, map[string]string) {
+
+		w := httptest.NewRecorder()
+		h.ReadyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+
+		var body struct {
+			Checks map[string]string `json:"checks"`
+		}
+
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+
+		return w.Code, body.Checks
+	}
+
+	if code, checks := readyz(); code != http.StatusOK || checks["config"] != "ok" {
+		t.Fatalf("readyz = %d %v, want 200", code, checks)
+	}
+
+	// The previous config stays active, so the bot stays ready
+	loadErr = errors.New("invalid config")
+	reloader.Reload()
+
+	code, checks := readyz()
+
+	if code != http.StatusOK {
+		t.Errorf("readyz after a failed reload = %d %v, want 200", code, checks)
+	}
+
+	if !strings.Contains(checks["config"], "invalid config") {
+		t.Errorf("config check = %q, want the reload error", checks["config"])
+	}
+}
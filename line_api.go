@@ -2,18 +2,70 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// Default deadline for a single outbound API call
+const defaultRequestTimeout time.Duration = 10 * time.Second
+
+// Client is used for all outbound calls to the LINE Messaging API.
+// Pointing BaseUrl at a local server makes it possible to test the bot without hitting api.line.me.
+type Client struct {
+	BaseUrl     string
+	AccessToken string
+	HTTPClient  *http.Client
+	Logger      *Logger
+
+	// Deadline applied to every call on top of the caller's context. Zero means no extra deadline.
+	Timeout time.Duration
+
+	// Retry policy for calls that support the X-Line-Retry-Key header
+	RetryPolicy RetryPolicy
+
+	// Shared by all outbound calls. Nil disables client-side rate limiting.
+	RateLimiter *RateLimiter
+
+	// Tracks the monthly message budget for pushes. Nil disables quota tracking.
+	Quota *QuotaTracker
+}
+
+// Context key holding the name of the API endpoint a request is for
+type endpointContextKey struct{}
+
+func endpointFromContext(ctx context.Context) string {
+
+	endpoint, _ := ctx.Value(endpointContextKey{}).(string)
+
+	return endpoint
+}
+
+// Wraps a response body so that the request's context is cancelled when the body is closed
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *cancelReadCloser) Close() error {
+
+	err := r.ReadCloser.Close()
+	r.cancel()
+
+	return err
+}
+
 type Template struct {
 	Type              string           `json:"type,omitempty"`
 	ThumbnailImageUrl string           `json:"thumbnailImageUrl,omitempty"`
-	Title             string           `json:"menu,omitempty"`
+	Title             string           `json:"title,omitempty"`
 	Text              string           `json:"text,omitempty"`
 	Actions           []TemplateAction `json:"actions,omitempty"`
 	Columns           []Column         `json:"columns,omitempty"`
@@ -25,6 +77,16 @@ type TemplateAction struct {
 	Data  string `json:"data,omitempty"`
 	Text  string `json:"text,omitempty"`
 	Uri   string `json:"uri,omitempty"`
+
+	// Datetime picker actions. Mode is date, time or datetime, and the values are formatted
+	// accordingly. See NewDatetimePickerAction.
+	Mode    string `json:"mode,omitempty"`
+	Initial string `json:"initial,omitempty"`
+	Max     string `json:"max,omitempty"`
+	Min     string `json:"min,omitempty"`
+
+	// Rich menu switch actions
+	RichMenuAliasId string `json:"richMenuAliasId,omitempty"`
 }
 
 type Column struct {
@@ -46,6 +108,16 @@ type Profile struct {
 	StatusMessage string `json:"statusMessage,omitempty"`
 }
 
+type BotInfo struct {
+	UserId         string `json:"userId,omitempty"`
+	BasicId        string `json:"basicId,omitempty"`
+	PremiumId      string `json:"premiumId,omitempty"`
+	DisplayName    string `json:"displayName,omitempty"`
+	PictureUrl     string `json:"pictureUrl,omitempty"`
+	ChatMode       string `json:"chatMode,omitempty"`
+	MarkAsReadMode string `json:"markAsReadMode,omitempty"`
+}
+
 type ImagemapArea struct {
 	X      int32 `json:"x,omitempty"`
 	Y      int32 `json:"y,omitempty"`
@@ -70,7 +142,7 @@ type PushMessage struct {
 	Messages []ReplyMessage `json:"messages"`
 }
 
-func SendImageMap(replyToken string) error {
+func SendImageMap(ctx context.Context, b *Bot, replyToken string) error {
 
 	zone1 := ImagemapActions{
 		Type:    "uri",
@@ -87,13 +159,13 @@ func SendImageMap(replyToken string) error {
 	replyMessage := ReplyMessage{
 
 		Type:     "imagemap",
-		BaseUrl:  "https://line-bot-test-app-v2.herokuapp.com/images/imagemap",
+		BaseUrl:  b.Config.imageUrl("imagemap"),
 		AltText:  "This is an imagemap",
 		BaseSize: ImagemapBaseSize{Height: 636, Width: 1040},
 		Actions:  []ImagemapActions{zone1, zone2},
 	}
 
-	err := SendReplyMessage(replyToken, []ReplyMessage{replyMessage})
+	err := b.Client.SendReplyMessage(ctx, replyToken, []ReplyMessage{replyMessage})
 
 	if err != nil {
 		return err
@@ -102,232 +174,456 @@ func SendImageMap(replyToken string) error {
 	return nil
 }
 
-func SendPushMessage(messages []ReplyMessage, toId string) error {
+// Create a new API client. If httpClient or logger are nil, defaults are used.
+func NewClient(baseUrl string, accessToken string, httpClient *http.Client, logger *Logger) *Client {
 
-	url := alphaApiEndpoint + "message/push"
+	if !strings.HasSuffix(baseUrl, "/") {
+		baseUrl += "/"
+	}
 
-	if os.Getenv("USE_REAL_ENVIRONMENT") == "TRUE" {
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
 
-		url = realApiEndpoint + "message/push"
+	if logger == nil {
+		logger = rootLogger
+	}
 
+	return &Client{
+		BaseUrl:     baseUrl,
+		AccessToken: accessToken,
+		HTTPClient:  httpClient,
+		Logger:      logger,
+		Timeout:     defaultRequestTimeout,
+		RetryPolicy: defaultRetryPolicy,
+		RateLimiter: NewRateLimiter(nil),
 	}
+}
 
-	var jsonPayload []byte = nil
-	var err error
+// Create a new API client using the bot's configuration
+func NewClientFromConfig(cfg *Config) *Client {
 
-	pushMessage := PushMessage{
-		ToId:     toId,
-		Messages: messages,
+	client := NewClient(cfg.APIEndpoint, cfg.ChannelAccessToken, nil, channelLogger(cfg.ChannelId))
+	client.Timeout = cfg.APITimeout
+
+	if cfg.RateLimits != nil {
+		client.RateLimiter = NewRateLimiter(cfg.RateLimits)
+	}
+
+	if cfg.MessageQuotaBudget >= 0 {
+		client.Quota = NewQuotaTracker(cfg.MessageQuotaBudget, cfg.QueuePushWhenQuotaExhausted)
 	}
 
-	jsonPayload, err = json.Marshal(pushMessage)
+	return client
+}
+
+// Build an authorized request for the given path relative to the client's base url.
+// The endpoint names the API being called and selects the rate limit that applies to it.
+func (c *Client) newRequest(ctx context.Context, endpoint string, method string, path string, body io.Reader) (*http.Request, error) {
 
-	log.Printf("SendPushMessage(): Request JSON: " + string(jsonPayload))
+	req, err := http.NewRequest(method, c.BaseUrl+path, body)
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonPayload))
+	if err != nil {
+		return nil, err
+	}
 
-	if os.Getenv("USE_REAL_ENVIRONMENT") == "TRUE" {
+	req.Header.Set("Authorization", "Bearer "+c.AccessToken)
 
-		req.Header.Set("Authorization", "Bearer "+os.Getenv("REAL_LINE_CHANNEL_ACCESS_TOKEN"))
+	return req.WithContext(context.WithValue(ctx, endpointContextKey{}, endpoint)), nil
+}
 
-	} else {
+// Send a request and return the response. Any status other than 2xx, such as the 202 that
+// narrowcasts are accepted with, is returned as an APIError.
+// The caller is responsible for closing the response body.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+
+	// The path isn't recorded, as it can contain user and group IDs
+	ctx, span := startSpan(req.Context(), req.Method+" "+endpointFromContext(req.Context()), SpanKindClient,
+		"http.method", req.Method,
+		"line.endpoint", endpointFromContext(req.Context()),
+	)
+	defer span.End()
+
+	if span != nil {
+		req = req.WithContext(ctx)
+		req.Header.Set("traceparent", span.traceparent())
+	}
 
-		req.Header.Set("Authorization", "Bearer "+os.Getenv("BETA_LINE_CHANNEL_ACCESS_TOKEN"))
+	if c.RateLimiter != nil {
 
+		start := time.Now()
+
+		if err := c.RateLimiter.Wait(req.Context(), endpointFromContext(req.Context())); err != nil {
+			span.SetError(err)
+			return nil, err
+		}
+
+		span.SetAttributes("line.rate_limit_wait_ms", float64(time.Since(start))/float64(time.Millisecond))
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.HTTPClient.Do(req)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
 	if err != nil {
-		panic(err)
+		apiRequests.Inc(endpointFromContext(req.Context()), "error")
+		span.SetError(err)
+		return nil, err
 	}
 
-	defer resp.Body.Close()
-	log.Println("Response Status:", resp.Status)
-	log.Println("Response Headers:", resp.Header)
-	body, _ := ioutil.ReadAll(resp.Body)
-	log.Println("Response Body:", string(body))
+	apiRequests.Inc(endpointFromContext(req.Context()), strconv.Itoa(resp.StatusCode))
 
-	if resp.StatusCode != http.StatusOK {
+	span.SetAttributes("http.status_code", resp.StatusCode, "line.request_id", resp.Header.Get("X-Line-Request-Id"))
 
-		return &APIError{
-			Code:     resp.StatusCode,
-			Response: string(body),
-		}
+	if resp.StatusCode/100 != 2 {
+		span.SetError(errors.New(resp.Status))
 	}
 
-	return nil
+	logger := c.logger(req.Context()).With(
+		"endpoint", endpointFromContext(req.Context()),
+		"status", resp.StatusCode,
+		"lineRequestId", resp.Header.Get("X-Line-Request-Id"),
+	)
 
-}
+	if resp.StatusCode/100 != 2 {
 
-func SendReplyMessage(replyToken string, replyMessages []ReplyMessage) error {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		logger.Warn("LINE API call failed", "body", body)
 
-	url := alphaApiEndpoint + "message/reply"
+		return nil, newAPIError(resp, body)
+	}
+
+	logger.Info("LINE API call succeeded")
+	logger.Debug("LINE API response headers", "headers", resp.Header)
 
-	if os.Getenv("USE_REAL_ENVIRONMENT") == "TRUE" {
+	return resp, nil
+}
 
-		url = realApiEndpoint + "message/reply"
+// Logger for a call: the one of the webhook or event it is made for, or else the client's
+func (c *Client) logger(ctx context.Context) *Logger {
 
+	if l, ok := ctx.Value(loggerContextKey{}).(*Logger); ok {
+		return l
 	}
 
-	var jsonPayload []byte = nil
-	var err error
+	return c.Logger
+}
 
-	reply := Reply{
-		SendReplyToken: replyToken,
-		Messages:       replyMessages,
+// Derive the context for a single call, applying the client's timeout if one is set
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+
+	if c.Timeout > 0 {
+		return context.WithTimeout(ctx, c.Timeout)
 	}
 
-	jsonPayload, err = json.Marshal(reply)
+	return context.WithCancel(ctx)
+}
+
+// Send a request and read the whole response body
+func (c *Client) do(req *http.Request) ([]byte, http.Header, error) {
+
+	ctx, cancel := c.withTimeout(req.Context())
+	defer cancel()
 
-	log.Printf("SendReplyMessage(): Request JSON: " + string(jsonPayload))
+	resp, err := c.send(req.WithContext(ctx))
 
-	//Make reply message
+	if err != nil {
+		return nil, nil, err
+	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonPayload))
-	if os.Getenv("USE_REAL_ENVIRONMENT") == "TRUE" {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Message content is binary, so only JSON bodies are logged
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		c.logger(ctx).Debug("LINE API response", "endpoint", endpointFromContext(ctx), "body", body)
+	}
 
-		req.Header.Set("Authorization", "Bearer "+os.Getenv("REAL_LINE_CHANNEL_ACCESS_TOKEN"))
+	return body, resp.Header, nil
+}
 
-	} else {
+// Build a POST request with a JSON body for the given path
+func (c *Client) newJSONRequest(ctx context.Context, path string, jsonPayload []byte) (*http.Request, error) {
 
-		req.Header.Set("Authorization", "Bearer "+os.Getenv("BETA_LINE_CHANNEL_ACCESS_TOKEN"))
+	req, err := c.newRequest(ctx, path, "POST", path, bytes.NewReader(jsonPayload))
 
+	if err != nil {
+		return nil, err
 	}
+
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	return req, nil
+}
+
+// Marshal the payload to JSON and POST it to the given path
+func (c *Client) postJSON(ctx context.Context, path string, payload interface{}) ([]byte, http.Header, error) {
+
+	jsonPayload, err := json.Marshal(payload)
+
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
 
-	defer resp.Body.Close()
-	log.Println("Response Status:", resp.Status)
-	log.Println("Response Headers:", resp.Header)
-	body, _ := ioutil.ReadAll(resp.Body)
-	log.Println("Response Body:", string(body))
+	c.logger(ctx).Debug("LINE API request", "method", "POST", "path", path, "body", jsonPayload)
+
+	req, err := c.newJSONRequest(ctx, path, jsonPayload)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c.do(req)
+}
+
+// Same as postJSON, but transient failures are retried with a stable X-Line-Retry-Key
+func (c *Client) postJSONWithRetry(ctx context.Context, path string, payload interface{}) ([]byte, http.Header, error) {
+
+	jsonPayload, err := json.Marshal(payload)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.logger(ctx).Debug("LINE API request", "method", "POST", "path", path, "body", jsonPayload)
+
+	return c.doWithRetry(ctx, func() (*http.Request, error) {
+		return c.newJSONRequest(ctx, path, jsonPayload)
+	})
+}
 
-	if resp.StatusCode != http.StatusOK {
+// Send a push message. If a quota tracker is set and the monthly budget has been reached,
+// the push is either queued for later or refused with ErrQuotaExceeded.
+func (c *Client) SendPushMessage(ctx context.Context, messages []ReplyMessage, toId string) error {
 
-		return &APIError{
-			Code:     resp.StatusCode,
-			Response: string(body),
+	pushMessage := PushMessage{
+		ToId:     toId,
+		Messages: messages,
+	}
+
+	if c.Quota != nil && !c.Quota.reserve(ctx, c, 1) {
+
+		if c.Quota.enqueue(pushMessage) {
+
+			c.logger(ctx).Info("Message budget reached, queued push message", "to", toId)
+
+			return nil
 		}
+
+		return ErrQuotaExceeded
 	}
 
-	return nil
+	return c.sendPush(ctx, pushMessage)
 
 }
 
-func LeaveGroupOrRoom(leaveType string, Id string) error {
+func (c *Client) sendPush(ctx context.Context, pushMessage PushMessage) error {
+
+	_, _, err := c.postJSONWithRetry(ctx, "message/push", pushMessage)
 
-	var url, endpoint string
+	return err
 
-	if os.Getenv("USE_REAL_ENVIRONMENT") == "TRUE" {
+}
 
-		endpoint = realApiEndpoint
+func (c *Client) SendReplyMessage(ctx context.Context, replyToken string, replyMessages []ReplyMessage) error {
 
-	} else {
-		endpoint = alphaApiEndpoint
+	reply := Reply{
+		SendReplyToken: replyToken,
+		Messages:       replyMessages,
 	}
 
-	// Set the API url based on the type of group/room that is being left
+	_, _, err := c.postJSON(ctx, "message/reply", reply)
+
+	return err
+
+}
+
+func (c *Client) LeaveGroupOrRoom(ctx context.Context, leaveType string, Id string) error {
+
+	var path string
+
+	// Set the API path based on the type of group/room that is being left
 	switch leaveType {
 
 	case "room":
 
-		url = endpoint + "room/" + Id + "/leave"
+		path = "room/" + Id + "/leave"
 
 	case "group":
 
-		url = endpoint + "group/" + Id + "/leave"
+		path = "group/" + Id + "/leave"
 
 	default:
 
-		panic(fmt.Sprintf("%s", "Calling LeaveGroupOrRoom on invalid leaveType!"))
+		return fmt.Errorf("Calling LeaveGroupOrRoom on invalid leaveType: %s", leaveType)
+
+	}
+
+	req, err := c.newRequest(ctx, leaveType+"/leave", "POST", path, nil)
 
+	if err != nil {
+		return err
 	}
 
-	var jsonPayload []byte = nil
-	var err error
+	_, _, err = c.do(req)
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonPayload))
-	if os.Getenv("USE_REAL_ENVIRONMENT") == "TRUE" {
+	return err
 
-		req.Header.Set("Authorization", "Bearer "+os.Getenv("REAL_LINE_CHANNEL_ACCESS_TOKEN"))
+}
 
-	} else {
+func (c *Client) GetProfile(ctx context.Context, userId string) (Profile, error) {
 
-		req.Header.Set("Authorization", "Bearer "+os.Getenv("BETA_LINE_CHANNEL_ACCESS_TOKEN"))
+	var userProfile Profile
 
+	req, err := c.newRequest(ctx, "profile", "GET", "profile/"+userId, nil)
+
+	if err != nil {
+		return userProfile, err
 	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
+
+	body, _, err := c.do(req)
+
 	if err != nil {
-		panic(err)
+		return userProfile, err
 	}
 
-	defer resp.Body.Close()
-	log.Println("Response Status:", resp.Status)
-	log.Println("Response Headers:", resp.Header)
-	body, _ := ioutil.ReadAll(resp.Body)
-	log.Println("Response Body:", string(body))
+	err = json.Unmarshal(body, &userProfile)
 
-	if resp.StatusCode != http.StatusOK {
+	return userProfile, err
 
-		return &APIError{
+}
+
+// Get the profile of a member of the group or room an event came from. Unlike GetProfile, this
+// works for users who are not friends of the bot.
+func (c *Client) GetMemberProfile(ctx context.Context, source Source, userId string) (Profile, error) {
+
+	var memberProfile Profile
+
+	var path string
+
+	switch source.Type {
+
+	case "group":
+
+		path = "group/" + source.GroupId + "/member/" + userId
+
+	case "room":
+
+		path = "room/" + source.RoomId + "/member/" + userId
+
+	default:
+
+		return memberProfile, fmt.Errorf("Calling GetMemberProfile on invalid source type: %s", source.Type)
 
-			Code:     resp.StatusCode,
-			Response: string(body),
-		}
 	}
 
-	return nil
+	req, err := c.newRequest(ctx, source.Type+"/member", "GET", path, nil)
+
+	if err != nil {
+		return memberProfile, err
+	}
+
+	body, _, err := c.do(req)
+
+	if err != nil {
+		return memberProfile, err
+	}
+
+	err = json.Unmarshal(body, &memberProfile)
+
+	return memberProfile, err
 
 }
 
-func GetProfile(userId string) Profile {
+// Download the content of an image, video or audio message.
+// The caller is responsible for closing the returned reader.
+func (c *Client) GetMessageContent(ctx context.Context, messageId string) (io.ReadCloser, error) {
 
-	client := &http.Client{}
+	req, err := c.newRequest(ctx, "message/content", "GET", "message/"+messageId+"/content", nil)
 
-	url := alphaApiEndpoint + "v2/bot/profile/"
+	if err != nil {
+		return nil, err
+	}
 
-	if os.Getenv("USE_REAL_ENVIRONMENT") == "TRUE" {
+	// The deadline has to cover reading the body, so it is only released once the caller closes it
+	ctx, cancel := c.withTimeout(ctx)
 
-		url = realApiEndpoint + "v2/bot/profile/"
+	resp, err := c.send(req.WithContext(ctx))
 
+	if err != nil {
+		cancel()
+		return nil, err
 	}
 
-	req, err := http.NewRequest("GET", url, nil)
-	if os.Getenv("USE_REAL_ENVIRONMENT") == "TRUE" {
+	return &cancelReadCloser{ReadCloser: resp.Body, cancel: cancel}, nil
 
-		req.Header.Set("Authorization", "Bearer "+os.Getenv("REAL_LINE_CHANNEL_ACCESS_TOKEN"))
+}
+
+func (c *Client) GetBotInfo(ctx context.Context) (BotInfo, error) {
 
-	} else {
+	var info BotInfo
 
-		req.Header.Set("Authorization", "Bearer "+os.Getenv("BETA_LINE_CHANNEL_ACCESS_TOKEN"))
+	req, err := c.newRequest(ctx, "info", "GET", "info", nil)
 
+	if err != nil {
+		return info, err
 	}
 
-	resp, err := client.Do(req)
+	body, _, err := c.do(req)
 
 	if err != nil {
-		panic(err)
+		return info, err
 	}
 
-	decoder := json.NewDecoder(resp.Body)
+	err = json.Unmarshal(body, &info)
 
-	var userProfile Profile
+	return info, err
+
+}
+
+func (c *Client) GetMessageQuota(ctx context.Context) (MessageQuota, error) {
+
+	var quota MessageQuota
+
+	req, err := c.newRequest(ctx, "message/quota", "GET", "message/quota", nil)
+
+	if err != nil {
+		return quota, err
+	}
+
+	body, _, err := c.do(req)
+
+	if err != nil {
+		return quota, err
+	}
 
-	err = decoder.Decode(&userProfile)
+	err = json.Unmarshal(body, &quota)
+
+	return quota, err
+
+}
+
+func (c *Client) GetMessageQuotaConsumption(ctx context.Context) (MessageQuotaConsumption, error) {
+
+	var consumption MessageQuotaConsumption
+
+	req, err := c.newRequest(ctx, "message/quota/consumption", "GET", "message/quota/consumption", nil)
 
 	if err != nil {
-		panic(err)
+		return consumption, err
 	}
 
-	return userProfile
+	body, _, err := c.do(req)
+
+	if err != nil {
+		return consumption, err
+	}
+
+	err = json.Unmarshal(body, &consumption)
+
+	return consumption, err
 
 }
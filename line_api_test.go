@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestClientSendReplyMessage(t *testing.T) {
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	err := s.client().SendReplyMessage(context.Background(), "reply-token", []ReplyMessage{{Type: "text", Text: "Hello"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := s.RequestsTo("message/reply")
+
+	if len(requests) != 1 {
+		t.Fatalf("got %d reply requests, want 1", len(requests))
+	}
+
+	r := requests[0]
+
+	if r.Method != "POST" {
+		t.Errorf("method = %s, want POST", r.Method)
+	}
+
+	if got := r.Header.Get("Authorization"); got != "Bearer test-token" {
+		t.Errorf("Authorization = %q, want the bearer token", got)
+	}
+
+	var reply Reply
+	r.decode(t, &reply)
+
+	if reply.SendReplyToken != "reply-token" || len(reply.Messages) != 1 || reply.Messages[0].Text != "Hello" {
+		t.Errorf("reply = %+v", reply)
+	}
+}
+
+func TestClientGetProfile(t *testing.T) {
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	s.respond("profile/U123", http.StatusOK, `{"displayName": "Tester", "userId": "U123"}`)
+
+	profile, err := s.client().GetProfile(context.Background(), "U123")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if profile.DisplayName != "Tester" {
+		t.Errorf("displayName = %q, want Tester", profile.DisplayName)
+	}
+}
+
+func TestClientAPIError(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		code     int
+		body     string
+		sentinel error
+	}{
+		{"invalid reply token", http.StatusBadRequest, `{"message": "Invalid reply token"}`, ErrInvalidReplyToken},
+		{"unauthorized", http.StatusUnauthorized, `{"message": "Authentication failed"}`, ErrUnauthorized},
+		{"not found", http.StatusNotFound, `{"message": "Not found"}`, ErrNotFound},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			s := newFakeLINEServer()
+			defer s.Close()
+
+			s.respond("message/reply", tt.code, tt.body)
+
+			err := s.client().SendReplyMessage(context.Background(), "reply-token", []ReplyMessage{{Type: "text", Text: "Hello"}})
+
+			var apiErr *APIError
+
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("err = %v, want an APIError", err)
+			}
+
+			if apiErr.Code != tt.code || apiErr.RequestId != "test-request-id" {
+				t.Errorf("code = %d, request ID = %q", apiErr.Code, apiErr.RequestId)
+			}
+
+			if !errors.Is(err, tt.sentinel) {
+				t.Errorf("errors.Is(%v, %v) = false", err, tt.sentinel)
+			}
+		})
+	}
+}
+
+// Handlers can be tested end to end against the fake server
+func TestProcessFollowEvent(t *testing.T) {
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	s.respond("profile/U123", http.StatusOK, `{"displayName": "Tester"}`)
+
+	e := Event{Type: "follow", ReplyToken: "reply-token", Source: Source{Type: "user", UserId: "U123"}}
+
+	if err := ProcessEvent(context.Background(), s.bot(t), e); err != nil {
+		t.Fatal(err)
+	}
+
+	replies := s.replies(t)
+
+	if len(replies) != 1 || len(replies[0]) != 3 || replies[0][0].Text != "Hi, Tester!!" {
+		t.Errorf("replies = %+v", replies)
+	}
+}
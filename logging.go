@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func ParseLevel(name string) (Level, error) {
+
+	for level, levelName := range levelNames {
+
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level: %s", name)
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// What can be redacted from logs, and the names of the fields that hold it
+const (
+	RedactUserIds       = "userId"
+	RedactReplyTokens   = "replyToken"
+	RedactText          = "text"
+	RedactAuthorization = "authorization"
+)
+
+var redactedFields = map[string][]string{
+	// Postback data holds the ID of the chat it was sent to
+	RedactUserIds:       {"userId", "groupId", "roomId", "to", "data"},
+	RedactReplyTokens:   {"replyToken"},
+	RedactText:          {"text"},
+	RedactAuthorization: {"authorization"},
+}
+
+// Everything is redacted unless configured otherwise
+var defaultRedactions = []string{RedactUserIds, RedactReplyTokens, RedactText, RedactAuthorization}
+
+const redacted string = "[redacted]"
+
+// Writes log entries as JSON objects, one per line. Loggers created with With share the output
+// and settings of their parent, and add fields to every entry.
+type Logger struct {
+	out    *syncWriter
+	level  Level
+	redact map[string]bool
+
+	// Alternating keys and values
+	fields []interface{}
+}
+
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Create a logger that writes entries at or above the level, redacting the given kinds of values
+func NewLogger(w io.Writer, level Level, redactions []string) *Logger {
+
+	redact := make(map[string]bool)
+
+	for _, redaction := range redactions {
+
+		for _, field := range redactedFields[redaction] {
+			redact[strings.ToLower(field)] = true
+		}
+	}
+
+	return &Logger{
+		out:    &syncWriter{w: w},
+		level:  level,
+		redact: redact,
+	}
+}
+
+// Logger used when there is no more specific one. Replaced once the config is loaded.
+var rootLogger = NewLogger(os.Stderr, LevelInfo, defaultRedactions)
+
+// Return a logger that adds the key/value pairs to every entry
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+
+	child := *l
+	child.fields = append(append([]interface{}(nil), l.fields...), keyvals...)
+
+	return &child
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(LevelDebug, msg, keyvals)
+}
+
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.log(LevelInfo, msg, keyvals)
+}
+
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.log(LevelWarn, msg, keyvals)
+}
+
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.log(LevelError, msg, keyvals)
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+
+	if !l.Enabled(level) {
+		return
+	}
+
+	var buf bytes.Buffer
+
+	buf.WriteString(`{"time":`)
+	writeJSONValue(&buf, time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(&buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(&buf, msg)
+
+	all := append(append([]interface{}(nil), l.fields...), keyvals...)
+
+	for i := 0; i < len(all); i += 2 {
+
+		key := fmt.Sprint(all[i])
+
+		var value interface{} = "(missing)"
+
+		if i+1 < len(all) {
+			value = all[i+1]
+		}
+
+		buf.WriteByte(',')
+		writeJSONValue(&buf, key)
+		buf.WriteByte(':')
+		writeJSONValue(&buf, l.redactValue(key, value))
+	}
+
+	buf.WriteString("}\n")
+
+	l.out.mu.Lock()
+	l.out.w.Write(buf.Bytes())
+	l.out.mu.Unlock()
+}
+
+// Replace the value if its field is redacted, and redact the fields inside JSON bodies and headers
+func (l *Logger) redactValue(key string, value interface{}) interface{} {
+
+	if l.redact[strings.ToLower(key)] {
+		return redacted
+	}
+
+	switch v := value.(type) {
+
+	case error:
+
+		return v.Error()
+
+	case json.RawMessage:
+
+		return l.redactJSON(v)
+
+	case []byte:
+
+		return l.redactJSON(v)
+
+	case http.Header:
+
+		headers := make(map[string]interface{}, len(v))
+
+		for name, values := range v {
+			headers[name] = l.redactValue(name, strings.Join(values, ", "))
+		}
+
+		return headers
+
+	case fmt.Stringer:
+
+		return v.String()
+	}
+
+	// Structs and collections may hold redacted fields too
+	switch reflect.ValueOf(value).Kind() {
+
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array, reflect.Ptr:
+
+		if encoded, err := json.Marshal(value); err == nil {
+			return l.redactJSON(encoded)
+		}
+	}
+
+	return value
+}
+
+// Redact the fields of a JSON document. Anything that isn't JSON is logged as a string.
+func (l *Logger) redactJSON(body []byte) interface{} {
+
+	var doc interface{}
+
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return string(body)
+	}
+
+	return l.redactDocument(doc)
+}
+
+func (l *Logger) redactDocument(doc interface{}) interface{} {
+
+	switch v := doc.(type) {
+
+	case map[string]interface{}:
+
+		for key, value := range v {
+
+			if l.redact[strings.ToLower(key)] {
+				v[key] = redacted
+				continue
+			}
+
+			v[key] = l.redactDocument(value)
+		}
+
+	case []interface{}:
+
+		for i, value := range v {
+			v[i] = l.redactDocument(value)
+		}
+	}
+
+	return doc
+}
+
+func writeJSONValue(buf *bytes.Buffer, value interface{}) {
+
+	encoded, err := json.Marshal(value)
+
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+
+	buf.Write(encoded)
+}
+
+// Adapts the logger for code that expects a standard library logger, such as http.Server
+func (l *Logger) StdLogger(level Level) *log.Logger {
+	return log.New(stdLogWriter{logger: l, level: level}, "", 0)
+}
+
+type stdLogWriter struct {
+	logger *Logger
+	level  Level
+}
+
+func (w stdLogWriter) Write(p []byte) (int, error) {
+
+	w.logger.log(w.level, strings.TrimSpace(string(p)), nil)
+
+	return len(p), nil
+}
+
+type loggerContextKey struct{}
+
+// Attach a logger to the context, so that everything done for a webhook or event logs with its IDs
+func withLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, l)
+}
+
+// The logger attached to the context, or the root logger
+func loggerFrom(ctx context.Context) *Logger {
+
+	if l, ok := ctx.Value(loggerContextKey{}).(*Logger); ok {
+		return l
+	}
+
+	return rootLogger
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Greeting sent to new members if neither the group settings nor the scenario have one
+const defaultMemberGreeting string = "Welcome, {{displayName}}!"
+
+// How the bot treats members joining and leaving a group or room
+type GroupSettings struct {
+	// Greet members that join
+	GreetMembers bool `json:"greetMembers"`
+
+	// Text of the greeting. {{displayName}} is replaced with the names of the new members.
+	// If empty, the memberJoined event of the scenario or the default greeting is used.
+	Greeting string `json:"greeting,omitempty"`
+}
+
+// Settings for groups that aren't configured
+var defaultGroupSettings = GroupSettings{GreetMembers: true}
+
+// The settings for a group or room. Groups that aren't listed use the "*" entry, if there is one.
+func (cfg *Config) groupSettings(groupId string) GroupSettings {
+
+	if settings, ok := cfg.Groups[groupId]; ok {
+		return settings
+	}
+
+	if settings, ok := cfg.Groups["*"]; ok {
+		return settings
+	}
+
+	return defaultGroupSettings
+}
+
+// ID of the group or room an event happened in
+func (s Source) groupOrRoomId() string {
+
+	if s.Type == "room" {
+		return s.RoomId
+	}
+
+	return s.GroupId
+}
+
+// Function that handles members joining a group or room the bot is in
+func ProcessMemberJoinedEvent(ctx context.Context, b *Bot, e Event) error {
+
+	logger := loggerFrom(ctx)
+
+	logger.Info("Processing member joined event", "groupId", e.Source.groupOrRoomId(), "members", len(e.Joined.Members))
+
+	settings := b.Config.groupSettings(e.Source.groupOrRoomId())
+
+	if !settings.GreetMembers {
+		return nil
+	}
+
+	var names []string
+
+	for _, member := range e.Joined.Members {
+
+		profile, err := b.Client.GetMemberProfile(ctx, e.Source, member.UserId)
+
+		// A member's profile may not be available, but the others can still be greeted
+		if err != nil {
+			logger.Warn("Could not get the profile of a new member", "userId", member.UserId, "error", err)
+			continue
+		}
+
+		if profile.DisplayName != "" {
+			names = append(names, profile.DisplayName)
+		}
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	vars := map[string]string{
+		"displayName": strings.Join(names, ", "),
+		"memberCount": strconv.Itoa(len(names)),
+	}
+
+	if settings.Greeting == "" {
+
+		if replies, ok := b.Scenario.eventReplies("memberJoined"); ok {
+			return b.replyWithScenario(ctx, e, replies, vars)
+		}
+	}
+
+	greeting := settings.Greeting
+
+	if greeting == "" {
+		greeting = defaultMemberGreeting
+	}
+
+	// The greeting goes through the scenario's variable substitution so that names are escaped
+	raw, err := json.Marshal(ReplyMessage{Type: "text", Text: greeting})
+
+	if err != nil {
+		return err
+	}
+
+	return b.replyWithScenario(ctx, e, ScenarioReplies{Replies: []json.RawMessage{raw}}, vars)
+}
+
+// Function that handles members leaving a group or room the bot is in.
+// There is no reply token for these events, so the bot can only take note.
+func ProcessMemberLeftEvent(ctx context.Context, b *Bot, e Event) error {
+
+	for _, member := range e.Left.Members {
+		loggerFrom(ctx).Info("Member left", "groupId", e.Source.groupOrRoomId(), "userId", member.UserId)
+	}
+
+	return nil
+}
@@ -1,20 +1,22 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 )
 
 const alphaApiEndpoint string = "https://api.line-beta.me/v2/bot/"
 const realApiEndpoint string = "https://api.line.me/v2/bot/"
-const defaultMaxStoredImages int32 = 30
+const defaultMaxStoredImages int = 30
 
 type Message struct {
 	Id        string  `json:"id,omitempty"`
@@ -47,7 +49,9 @@ type ReplyMessage struct {
 	Template           Template          `json:"template,omitempty"`
 }
 
-func ReplyToMessage(replyToken string, m Message) error {
+func ReplyToMessage(ctx context.Context, b *Bot, replyToken string, m Message) error {
+
+	c := b.Client
 
 	// Make Reply API Request
 
@@ -60,7 +64,7 @@ func ReplyToMessage(replyToken string, m Message) error {
 			Type: m.Type,
 		}
 
-		err := SendReplyMessage(replyToken, []ReplyMessage{replyMessage})
+		err := c.SendReplyMessage(ctx, replyToken, []ReplyMessage{replyMessage})
 
 		if err != nil {
 			return err
@@ -68,10 +72,20 @@ func ReplyToMessage(replyToken string, m Message) error {
 
 	case "image":
 
-		// TODO: Put this url in config file
-		imagePath := GetContent(m.Type, m.Id)
-		image_url := os.Getenv("BOT_HOST") + "images/" + imagePath
-		preview_image_url := os.Getenv("BOT_HOST") + "images/" + CreatePreviewImage(imagePath)
+		imagePath, err := GetContent(ctx, b, m.Type, m.Id)
+
+		if err != nil {
+			return err
+		}
+
+		previewImagePath, err := CreatePreviewImage(ctx, imagePath)
+
+		if err != nil {
+			return err
+		}
+
+		image_url := b.Config.imageUrl(imagePath)
+		preview_image_url := b.Config.imageUrl(previewImagePath)
 
 		replyMessage := ReplyMessage{
 			Type:               m.Type,
@@ -79,16 +93,21 @@ func ReplyToMessage(replyToken string, m Message) error {
 			PreviewImageUrl:    preview_image_url,
 		}
 
-		err := SendReplyMessage(replyToken, []ReplyMessage{replyMessage})
+		err = c.SendReplyMessage(ctx, replyToken, []ReplyMessage{replyMessage})
 
 		if err != nil {
 			return err
 		}
 	case "video":
 
-		videoPath := GetContent(m.Type, m.Id)
-		video_url := os.Getenv("BOT_HOST") + "images/" + videoPath
-		preview_image_url := os.Getenv("BOT_HOST") + "images/video_thumbnail.jpg"
+		videoPath, err := GetContent(ctx, b, m.Type, m.Id)
+
+		if err != nil {
+			return err
+		}
+
+		video_url := b.Config.imageUrl(videoPath)
+		preview_image_url := b.Config.imageUrl("video_thumbnail.jpg")
 
 		replyMessage := ReplyMessage{
 
@@ -97,15 +116,20 @@ func ReplyToMessage(replyToken string, m Message) error {
 			PreviewImageUrl:    preview_image_url,
 		}
 
-		err := SendReplyMessage(replyToken, []ReplyMessage{replyMessage})
+		err = c.SendReplyMessage(ctx, replyToken, []ReplyMessage{replyMessage})
 
 		if err != nil {
 			return err
 		}
 	case "audio":
 
-		audioPath := GetContent(m.Type, m.Id)
-		audio_url := os.Getenv("BOT_HOST") + "images/" + audioPath
+		audioPath, err := GetContent(ctx, b, m.Type, m.Id)
+
+		if err != nil {
+			return err
+		}
+
+		audio_url := b.Config.imageUrl(audioPath)
 
 		replyMessage := ReplyMessage{
 
@@ -114,7 +138,7 @@ func ReplyToMessage(replyToken string, m Message) error {
 			Duration:           "240000",
 		}
 
-		err := SendReplyMessage(replyToken, []ReplyMessage{replyMessage})
+		err = c.SendReplyMessage(ctx, replyToken, []ReplyMessage{replyMessage})
 
 		if err != nil {
 			return err
@@ -127,10 +151,7 @@ func ReplyToMessage(replyToken string, m Message) error {
 			StickerId: m.StickerId,
 		}
 
-		log.Println("PackageId: " + m.PackageId)
-		log.Println("Stickerid: " + m.StickerId)
-
-		err := SendReplyMessage(replyToken, []ReplyMessage{replyMessage})
+		err := c.SendReplyMessage(ctx, replyToken, []ReplyMessage{replyMessage})
 
 		if err != nil {
 			return err
@@ -145,13 +166,7 @@ func ReplyToMessage(replyToken string, m Message) error {
 			Longitude: m.Longitude,
 		}
 
-		log.Println("Message Type: " + m.Type)
-		log.Println("Title: " + m.Title)
-		log.Println("Address: " + m.Address)
-		log.Println("Latitude: ", m.Latitude)
-		log.Println("Longitude: ", m.Longitude)
-
-		err := SendReplyMessage(replyToken, []ReplyMessage{replyMessage})
+		err := c.SendReplyMessage(ctx, replyToken, []ReplyMessage{replyMessage})
 
 		if err != nil {
 			return err
@@ -171,39 +186,48 @@ func CheckMAC(message, messageMAC, key []byte) bool {
 	return hmac.Equal(messageMAC, expectedMAC)
 }
 
-func APIPathHandler(w http.ResponseWriter, r *http.Request) {
+func APIPathHandler(b *Bot, queue *EventQueue, guard *ReplayGuard, w http.ResponseWriter, r *http.Request) {
 
-	fmt.Println("This is the Default Path Handler")
-	log.Println("Entered the default Path Handler")
+	// Everything logged for this webhook and its events carries the same request ID
+	requestId, _ := newUUID()
+	logger := b.Client.Logger.With("requestId", requestId)
+	ctx := withLogger(r.Context(), logger)
 
-	// Verify Request Signature
+	logger.Debug("Received webhook", "remoteAddr", r.RemoteAddr)
+
+	ctx, span := startSpan(ctx, "webhook", SpanKindServer, "requestId", requestId, "channel", channelLabel(b.Config.ChannelId))
+	defer span.End()
 
+	_, readSpan := startSpan(ctx, "read body", SpanKindInternal)
 	defer r.Body.Close()
 	body, err := ioutil.ReadAll(r.Body)
+	readSpan.SetAttributes("bytes", len(body))
+	readSpan.SetError(err)
+	readSpan.End()
 
 	if err != nil {
-		http.Error(w, "Failed to read the response body: "+err.Error(), http.StatusInternalServerError)
+		logger.Warn("Failed to read the request body", "error", err)
+		http.Error(w, "Failed to read the request body", http.StatusBadRequest)
+		return
 	}
 
-	if os.Getenv("SKIP_SIGNATURE_VERIFICATION") != "TRUE" {
+	// Verify Request Signature
+	_, verifySpan := startSpan(ctx, "verify signature", SpanKindInternal, "skipped", b.Config.SkipSignatureVerification)
+
+	if !b.Config.SkipSignatureVerification {
 
 		decoded_signature, err := base64.StdEncoding.DecodeString(r.Header.Get("X-Line-Signature"))
 
 		if err != nil {
-			http.Error(w, "Failed to read the response body: "+err.Error(), http.StatusInternalServerError)
-
+			logger.Warn("Could not decode the request signature", "error", err)
+			verifySpan.SetError(err)
+			verifySpan.End()
+			webhookRequests.Inc(channelLabel(b.Config.ChannelId), "invalid")
+			http.Error(w, "ERROR: Message Authentication Failed", http.StatusUnauthorized)
+			return
 		}
 
-		var channel_secret string
-
-		if os.Getenv("USE_REAL_ENVIRONMENT") == "TRUE" {
-
-			channel_secret = os.Getenv("REAL_LINE_CHANNEL_SECRET")
-		} else {
-
-			channel_secret = os.Getenv("BETA_LINE_CHANNEL_SECRET")
-
-		}
+		channel_secret := b.Config.ChannelSecret
 
 		mac := hmac.New(sha256.New, []byte(channel_secret))
 		mac.Write(body)
@@ -211,92 +235,275 @@ func APIPathHandler(w http.ResponseWriter, r *http.Request) {
 
 		if CheckMAC(body, decoded_signature, []byte(channel_secret)) == false {
 
-			log.Println("ERROR: Message Verification Has Failed.")
+			logger.Warn("Message verification has failed")
+			verifySpan.SetError(errors.New("message verification has failed"))
+			verifySpan.End()
+			webhookRequests.Inc(channelLabel(b.Config.ChannelId), "invalid")
 			http.Error(w, "ERROR: Message Authentication Failed", http.StatusUnauthorized)
 			return
 		} else {
 
-			log.Println("Message Verification Has Succeeded")
+			logger.Debug("Message verification has succeeded")
+			webhookRequests.Inc(channelLabel(b.Config.ChannelId), "valid")
 
 		}
 
 	} else {
 
-		log.Println("Bot is set to bypass Signature Verification")
+		logger.Debug("Bot is set to bypass signature verification")
+		webhookRequests.Inc(channelLabel(b.Config.ChannelId), "skipped")
 	}
 
+	verifySpan.End()
+
 	request := &struct {
 		Events []*Event `json:"events"`
 	}{}
 
+	_, parseSpan := startSpan(ctx, "parse body", SpanKindInternal)
 	err = json.Unmarshal(body, &request)
+	parseSpan.SetAttributes("events", len(request.Events))
+	parseSpan.SetError(err)
+	parseSpan.End()
 
 	if err != nil {
-		panic(err)
+		logger.Warn("Could not parse webhook body", "error", err)
+		http.Error(w, "Invalid webhook body", http.StatusBadRequest)
+		return
 	}
 
-	for _, event := range request.Events {
-		log.Println("replytoken: " + event.ReplyToken)
-		log.Println("type: " + event.Type)
-		log.Println("timestamp: ", event.Timestamp)
-
-		switch event.Type {
-		case "message":
-			err = ProcessMessageEvent(*event)
-		case "follow":
-			err = ProcessFollowEvent(*event)
-		case "unfollow":
-			ProcessUnfollowEvent(*event)
-		case "join":
-			err = ProcessJoinEvent(*event)
-		case "leave":
-			ProcessLeaveEvent(*event)
-		case "postback":
-			err = ProcessPostbackEvent(*event)
-		default:
-			log.Println("Caught invalid event type!")
-			err = &APIError{
-				Code:     500,
-				Response: "Caught invalid event type: " + event.Type,
-			}
-		}
+	// A valid signature doesn't prove that the request isn't a captured one sent again
+	if guard != nil {
+
+		err := trace(ctx, "check replay", func(ctx context.Context) error {
+			return guard.Check(body, request.Events)
+		})
 
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			stale, replayed := guard.Rejections()
+			logger.Warn("Rejected webhook", "error", err, "staleRejections", stale, "replayedRejections", replayed)
+			http.Error(w, "ERROR: "+err.Error(), http.StatusForbidden)
+			return
 		}
 	}
 
+	// The events are handled by the queue's workers, so that LINE gets its response right away
+	err = trace(ctx, "enqueue events", func(ctx context.Context) error {
+		return queue.Enqueue(ctx, b, request.Events)
+	})
+
+	if err != nil {
+
+		if guard != nil {
+			guard.Forget(body)
+		}
+
+		logger.Error("Could not queue events", "error", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
 }
 
-func registerRouteHandlers() {
+// Handle a single webhook event
+func ProcessEvent(ctx context.Context, b *Bot, event Event) error {
+
+	loggerFrom(ctx).Info("Processing event", "replyToken", event.ReplyToken, "timestamp", event.Timestamp, "source", event.Source)
+
+	eventsReceived.Inc(event.Type)
+
+	var err error
+
+	switch event.Type {
+	case "message":
+		err = trace(ctx, "ProcessMessageEvent", func(ctx context.Context) error {
+			return ProcessMessageEvent(ctx, b, event)
+		})
+	case "follow":
+		err = trace(ctx, "ProcessFollowEvent", func(ctx context.Context) error {
+			return ProcessFollowEvent(ctx, b, event)
+		})
+	case "unfollow":
+		trace(ctx, "ProcessUnfollowEvent", func(ctx context.Context) error {
+			ProcessUnfollowEvent(ctx, b, event)
+			return nil
+		})
+	case "join":
+		err = trace(ctx, "ProcessJoinEvent", func(ctx context.Context) error {
+			return ProcessJoinEvent(ctx, b, event)
+		})
+	case "leave":
+		trace(ctx, "ProcessLeaveEvent", func(ctx context.Context) error {
+			ProcessLeaveEvent(ctx, b, event)
+			return nil
+		})
+	case "memberJoined":
+		err = trace(ctx, "ProcessMemberJoinedEvent", func(ctx context.Context) error {
+			return ProcessMemberJoinedEvent(ctx, b, event)
+		})
+	case "memberLeft":
+		err = trace(ctx, "ProcessMemberLeftEvent", func(ctx context.Context) error {
+			return ProcessMemberLeftEvent(ctx, b, event)
+		})
+	case "unsend":
+		err = trace(ctx, "ProcessUnsendEvent", func(ctx context.Context) error {
+			return ProcessUnsendEvent(ctx, b, event)
+		})
+	case "beacon":
+		err = trace(ctx, "ProcessBeaconEvent", func(ctx context.Context) error {
+			return ProcessBeaconEvent(ctx, b, event)
+		})
+	case "postback":
+		err = trace(ctx, "ProcessPostbackEvent", func(ctx context.Context) error {
+			return ProcessPostbackEvent(ctx, b, event)
+		})
+	default:
+		err = errors.New("Caught invalid event type: " + event.Type)
+	}
+
+	return err
 
-	log.Println("Registering Route Handlers")
+}
 
-	http.Handle("/images/", http.StripPrefix("/images/", http.FileServer(http.Dir("images"))))
+// Register the handlers on the mux and start the event queue and the background work, which
+// stops when the context is done
+func registerRouteHandlers(ctx context.Context, mux *http.ServeMux, cfg *Config, overrides map[string]string) (*EventQueue, *channelClients) {
 
-	http.HandleFunc("/api/", APIPathHandler)
+	rootLogger.Info("Registering route handlers")
 
-	var endpoint_port string
-	// If port is set an the environment variables, use that
-	if endpoint_port = os.Getenv("PORT"); endpoint_port == "" {
+	mux.Handle("/images/", http.StripPrefix("/images/", http.FileServer(http.Dir(imageDirectory))))
 
-		// Default endpoint is 12345
-		endpoint_port = "12345"
-		log.Println("setting port")
+	queue := NewEventQueue(cfg.EventWorkers, cfg.EventQueueDepth, cfg.EventQueueFull)
 
+	if cfg.WebhookEventTTL > 0 {
+		queue.Store = NewMemoryIdempotencyStore(cfg.WebhookEventTTL)
 	}
 
-	log.Println("Listening on port " + endpoint_port)
-	log.Fatal(http.ListenAndServe(":"+endpoint_port, nil)) //nil means the default Router Server is used
+	// Redacted events can't be replayed, so they are only redacted if configured to
+	var redact *Logger
+
+	if cfg.DeadLetterRedact {
+		redact = rootLogger
+	}
+
+	queue.DeadLetters = NewDeadLetterLog(cfg.DeadLetterFile, redact)
+
+	var guard *ReplayGuard
+
+	if cfg.WebhookMaxSkew > 0 {
+		guard = NewReplayGuard(cfg.WebhookMaxSkew, cfg.WebhookMaxRedeliveryAge)
+	}
+
+	// Clients are shared between reloads, unless their settings change
+	clients := &channelClients{ctx: ctx}
+
+	load := func() (Bots, error) {
+
+		cfg, err := LoadConfig(overrides)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return loadBots(cfg, clients)
+	}
+
+	reloader, err := NewReloader(load)
+
+	if err != nil {
+		rootLogger.Error("Failed to load the bots", "error", err)
+		os.Exit(1)
+	}
+
+	go reloader.Watch(ctx)
+
+	health := NewHealthChecker(reloader, queue)
+
+	NewGaugeFunc("line_bot_image_directory_bytes", "Total size of the files in the image directory.", imageDirectorySize)
+
+	NewGaugeFunc("line_bot_event_queue_depth", "Events waiting to be handled.", func() float64 {
+		depth, _ := queue.Len()
+		return float64(depth)
+	})
+
+	if guard != nil {
+
+		NewCounterFunc("line_bot_webhook_rejections_total", "Webhook requests rejected as replays, by reason.", "reason", func() map[string]float64 {
+			stale, replayed := guard.Rejections()
+			return map[string]float64{"stale": float64(stale), "replayed": float64(replayed)}
+		})
+	}
+
+	mux.Handle("/metrics", defaultMetrics)
+
+	mux.HandleFunc("/healthz", health.HealthzHandler)
+	mux.HandleFunc("/readyz", health.ReadyzHandler)
+	mux.HandleFunc("/version", health.VersionHandler)
+
+	// The default channel is served at /api/ and every other channel at /api/{channelId}/
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+
+		channelId := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/")
+
+		b := reloader.Bot(channelId)
+
+		if b == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.ContentLength > cfg.MaxWebhookBodySize {
+			http.Error(w, "Webhook body is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxWebhookBodySize)
+
+		APIPathHandler(b, queue, guard, w, r)
+	})
+
+	return queue, clients
 
 }
 
 func main() {
 
-	log.Println("V2 Test Bot Started")
+	rootLogger.Info("V2 test bot started")
+
+	overrides, err := ParseFlags(os.Args[1:])
+
+	if err != nil {
+		os.Exit(2)
+	}
+
+	cfg, err := LoadConfig(overrides)
+
+	if err != nil {
+		rootLogger.Error("Failed to load the configuration", "error", err)
+		os.Exit(1)
+	}
+
+	rootLogger = NewLogger(os.Stderr, cfg.LogLevel, cfg.LogRedactions)
+
+	// Anything still written with the standard logger ends up in the same format
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{logger: rootLogger, level: LevelInfo})
+
+	switch cfg.TraceExporter {
+	case TraceExporterStdout:
+		tracer = NewTracer(cfg.ServiceName, NewStdoutExporter(os.Stdout))
+	case TraceExporterOTLP:
+		tracer = NewTracer(cfg.ServiceName, NewOTLPExporter(cfg.OTLPEndpoint))
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
 
-	registerRouteHandlers()
+	mux := http.NewServeMux()
+	queue, clients := registerRouteHandlers(ctx, mux, cfg, overrides)
 
-	log.Println("Registered Route Handlers")
+	rootLogger.Info("Registered route handlers")
 
+	os.Exit(runServer(newHTTPServer(cfg, mux), cfg.ShutdownTimeout, queue, stop, clients))
 }
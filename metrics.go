@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Upper bounds of the histogram buckets, in seconds
+var defaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var webhookRequests = NewCounterVec("line_bot_webhook_requests_total", "Webhook requests received, by channel and signature verification result.", "channel", "signature")
+var eventsReceived = NewCounterVec("line_bot_events_total", "Webhook events handled, by event type.", "type")
+var commandDuration = NewHistogramVec("line_bot_command_duration_seconds", "Time spent handling a command.", defaultDurationBuckets, "command")
+var postbackDuration = NewHistogramVec("line_bot_postback_duration_seconds", "Time spent handling a postback, by action.", defaultDurationBuckets, "action")
+var apiRequests = NewCounterVec("line_bot_api_requests_total", "Calls to the LINE API, by endpoint and response status code.", "endpoint", "code")
+var apiRetries = NewCounterVec("line_bot_api_retries_total", "Calls to the LINE API that were retried, by endpoint.", "endpoint")
+var contentDownloadBytes = NewCounterVec("line_bot_content_download_bytes_total", "Bytes of message content downloaded, by media type.", "type")
+var previewDuration = NewHistogramVec("line_bot_preview_generation_seconds", "Time spent creating preview images.", defaultDurationBuckets)
+
+// A metric that can write itself in the Prometheus text format
+type metric interface {
+	write(w io.Writer)
+}
+
+// Collects metrics and serves them at /metrics
+type MetricsRegistry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// Registry that the metrics of the bot are registered in
+var defaultMetrics = &MetricsRegistry{}
+
+func (r *MetricsRegistry) register(m metric) {
+
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// A counter that is split by labels
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: make(map[string]*counterSeries),
+	}
+
+	defaultMetrics.register(c)
+
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+
+	key := strings.Join(labelValues, "\xff")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.series[key]
+
+	if !ok {
+		s = &counterSeries{labelValues: labelValues}
+		c.series[key] = s
+	}
+
+	s.value += value
+}
+
+func (c *CounterVec) write(w io.Writer) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	for _, key := range sortedKeys(c.series) {
+
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.labelValues, "", ""), formatValue(s.value))
+	}
+}
+
+// A histogram that is split by labels
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+
+	defaultMetrics.register(h)
+
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+
+	key := strings.Join(labelValues, "\xff")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+
+	if !ok {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+
+	for i, bound := range h.buckets {
+
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+
+	s.count++
+	s.sum += value
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	for _, key := range sortedKeys(h.series) {
+
+		s := h.series[key]
+
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labelValues, "le", formatValue(bound)), s.counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labelValues, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labelValues, "", ""), s.count)
+	}
+}
+
+// A metric whose value is read when the metrics are scraped
+type funcMetric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	collect func() map[string]float64
+}
+
+// Register a gauge whose value is returned by the function
+func NewGaugeFunc(name string, help string, value func() float64) {
+
+	defaultMetrics.register(&funcMetric{
+		name: name,
+		help: help,
+		kind: "gauge",
+		collect: func() map[string]float64 {
+			return map[string]float64{"": value()}
+		},
+	})
+}
+
+// Register a counter with a single label, whose values are returned by the function
+func NewCounterFunc(name string, help string, label string, values func() map[string]float64) {
+
+	defaultMetrics.register(&funcMetric{
+		name:    name,
+		help:    help,
+		kind:    "counter",
+		labels:  []string{label},
+		collect: values,
+	})
+}
+
+func (f *funcMetric) write(w io.Writer) {
+
+	values := f.collect()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+
+	for _, key := range sortedKeys(values) {
+
+		labels := ""
+
+		if len(f.labels) > 0 {
+			labels = formatLabels(f.labels, []string{key}, "", "")
+		}
+
+		fmt.Fprintf(w, "%s%s %s\n", f.name, labels, formatValue(values[key]))
+	}
+}
+
+// Total size of the files in the image directory
+func imageDirectorySize() float64 {
+
+	files, err := ioutil.ReadDir(imageDirectory)
+
+	if err != nil {
+		return 0
+	}
+
+	var size int64
+
+	for _, file := range files {
+
+		if !file.IsDir() {
+			size += file.Size()
+		}
+	}
+
+	return float64(size)
+}
+
+// Channel ID as a label value. The top-level channel has an empty ID.
+func channelLabel(channelId string) string {
+
+	if channelId == "" {
+		return "default"
+	}
+
+	return channelId
+}
+
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+
+	var pairs []string
+
+	for i, name := range names {
+
+		value := ""
+
+		if i < len(values) {
+			value = values[i]
+		}
+
+		pairs = append(pairs, name+"=\""+escapeLabelValue(value)+"\"")
+	}
+
+	if extraName != "" {
+		pairs = append(pairs, extraName+"=\""+extraValue+"\"")
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(m interface{}) []string {
+
+	var keys []string
+
+	switch m := m.(type) {
+	case map[string]*counterSeries:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]*histogramSeries:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]float64:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
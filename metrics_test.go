@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsOutput(t *testing.T) {
+
+	registry := &MetricsRegistry{}
+
+	counter := &CounterVec{name: "test_requests_total", help: "Requests, by path.", labels: []string{"path"}, series: make(map[string]*counterSeries)}
+	histogram := &HistogramVec{name: "test_duration_seconds", help: "Time spent.", labels: []string{"command"}, buckets: []float64{0.1, 1}, series: make(map[string]*histogramSeries)}
+
+	registry.register(counter)
+	registry.register(histogram)
+	registry.register(&funcMetric{name: "test_size_bytes", help: "Size.", kind: "gauge", collect: func() map[string]float64 {
+		return map[string]float64{"": 1.5e9}
+	}})
+
+	// Label values are escaped
+	counter.Inc("/api/")
+	counter.Add(2, `say "hi"`)
+	counter.Inc("back\\slash\nnewline")
+
+	// Buckets are cumulative
+	histogram.Observe(0.05, "help")
+	histogram.Observe(0.5, "help")
+	histogram.Observe(5, "help")
+
+	w := httptest.NewRecorder()
+	registry.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := `# HELP test_requests_total Requests, by path.
+# TYPE test_requests_total counter
+test_requests_total{path="/api/"} 1
+test_requests_total{path="back\\slash\nnewline"} 1
+test_requests_total{path="say \"hi\""} 2
+# HELP test_duration_seconds Time spent.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{command="help",le="0.1"} 1
+test_duration_seconds_bucket{command="help",le="1"} 2
+test_duration_seconds_bucket{command="help",le="+Inf"} 3
+test_duration_seconds_sum{command="help"} 5.55
+test_duration_seconds_count{command="help"} 3
+# HELP test_size_bytes Size.
+# TYPE test_size_bytes gauge
+test_size_bytes 1.5e+09
+`
+
+	if got := w.Body.String(); got != want {
+		t.Errorf("metrics =\n%s\nwant\n%s", got, want)
+	}
+
+	if got := w.Header().Get("Content-Type"); got != "text/plain; version=0.0.4" {
+		t.Errorf("Content-Type = %q", got)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+)
+
+// Max number of user IDs LINE accepts in a single multicast request
+const maxMulticastRecipients int = 500
+
+type Multicast struct {
+	ToIds    []string       `json:"to"`
+	Messages []ReplyMessage `json:"messages"`
+}
+
+type Broadcast struct {
+	Messages []ReplyMessage `json:"messages"`
+}
+
+type Narrowcast struct {
+	Messages  []ReplyMessage    `json:"messages"`
+	Recipient *Recipient        `json:"recipient,omitempty"`
+	Filter    *NarrowcastFilter `json:"filter,omitempty"`
+	Limit     *NarrowcastLimit  `json:"limit,omitempty"`
+}
+
+// Selects who a narrowcast is sent to.
+// Type is "audience", "redelivery" or "operator". Operators combine other recipients with And, Or and Not.
+type Recipient struct {
+	Type            string      `json:"type"`
+	AudienceGroupId int64       `json:"audienceGroupId,omitempty"`
+	RequestId       string      `json:"requestId,omitempty"`
+	And             []Recipient `json:"and,omitempty"`
+	Or              []Recipient `json:"or,omitempty"`
+	Not             *Recipient  `json:"not,omitempty"`
+}
+
+type NarrowcastFilter struct {
+	Demographic *DemographicFilter `json:"demographic,omitempty"`
+}
+
+// Filters narrowcast recipients by their attributes.
+// Type is "gender", "age", "appType", "area", "subscriptionPeriod" or "operator".
+// Gender, appType and area use OneOf, while age and subscriptionPeriod use Gte and Lt (e.g. "age_20", "day_7").
+type DemographicFilter struct {
+	Type  string              `json:"type"`
+	OneOf []string            `json:"oneOf,omitempty"`
+	Gte   string              `json:"gte,omitempty"`
+	Lt    string              `json:"lt,omitempty"`
+	And   []DemographicFilter `json:"and,omitempty"`
+	Or    []DemographicFilter `json:"or,omitempty"`
+	Not   *DemographicFilter  `json:"not,omitempty"`
+}
+
+type NarrowcastLimit struct {
+	Max                int  `json:"max,omitempty"`
+	UpToRemainingQuota bool `json:"upToRemainingQuota,omitempty"`
+}
+
+type NarrowcastProgress struct {
+	Phase             string `json:"phase,omitempty"`
+	SuccessCount      int64  `json:"successCount,omitempty"`
+	FailureCount      int64  `json:"failureCount,omitempty"`
+	TargetCount       int64  `json:"targetCount,omitempty"`
+	FailedDescription string `json:"failedDescription,omitempty"`
+	ErrorCode         int    `json:"errorCode,omitempty"`
+	AcceptedTime      string `json:"acceptedTime,omitempty"`
+	CompletedTime     string `json:"completedTime,omitempty"`
+}
+
+// Send the messages to any number of users. The IDs are split into requests of at most 500 users.
+// Returns the request ID of every request that was accepted, in order.
+func (c *Client) SendMulticastMessage(ctx context.Context, messages []ReplyMessage, toIds []string) ([]string, error) {
+
+	var requestIds []string
+
+	for start := 0; start < len(toIds); start += maxMulticastRecipients {
+
+		end := start + maxMulticastRecipients
+
+		if end > len(toIds) {
+			end = len(toIds)
+		}
+
+		if c.Quota != nil && !c.Quota.reserve(ctx, c, int64(end-start)) {
+			return requestIds, ErrQuotaExceeded
+		}
+
+		multicast := Multicast{
+			ToIds:    toIds[start:end],
+			Messages: messages,
+		}
+
+		_, header, err := c.postJSONWithRetry(ctx, "message/multicast", multicast)
+
+		if err != nil {
+
+			if c.Quota != nil {
+				c.Quota.refund(int64(end - start))
+			}
+
+			return requestIds, err
+		}
+
+		requestIds = append(requestIds, header.Get("X-Line-Request-Id"))
+	}
+
+	return requestIds, nil
+}
+
+// Send the messages to every user that has added the bot as a friend. Returns the request ID.
+// The number of friends isn't known in advance, so broadcasts are refused once the monthly
+// budget is used up.
+func (c *Client) SendBroadcastMessage(ctx context.Context, messages []ReplyMessage) (string, error) {
+
+	if c.Quota != nil && c.Quota.exhausted(ctx, c) {
+		return "", ErrQuotaExceeded
+	}
+
+	broadcast := Broadcast{
+		Messages: messages,
+	}
+
+	_, header, err := c.postJSONWithRetry(ctx, "message/broadcast", broadcast)
+
+	if err != nil {
+		return "", err
+	}
+
+	if c.Quota != nil {
+		c.Quota.invalidate()
+	}
+
+	return header.Get("X-Line-Request-Id"), nil
+}
+
+// Send a narrowcast. The returned request ID can be passed to GetNarrowcastProgress.
+// A narrowcast with a limit reserves that many messages from the budget; others are refused
+// once it is used up, like broadcasts.
+func (c *Client) SendNarrowcastMessage(ctx context.Context, narrowcast Narrowcast) (string, error) {
+
+	var reserved int64
+
+	if c.Quota != nil {
+
+		if narrowcast.Limit != nil && narrowcast.Limit.Max > 0 {
+
+			reserved = int64(narrowcast.Limit.Max)
+
+			if !c.Quota.reserve(ctx, c, reserved) {
+				return "", ErrQuotaExceeded
+			}
+
+		} else if c.Quota.exhausted(ctx, c) {
+			return "", ErrQuotaExceeded
+		}
+	}
+
+	_, header, err := c.postJSONWithRetry(ctx, "message/narrowcast", narrowcast)
+
+	if err != nil {
+
+		if c.Quota != nil {
+			c.Quota.refund(reserved)
+		}
+
+		return "", err
+	}
+
+	if c.Quota != nil {
+		c.Quota.invalidate()
+	}
+
+	return header.Get("X-Line-Request-Id"), nil
+}
+
+// Get the progress of a narrowcast that was sent with SendNarrowcastMessage
+func (c *Client) GetNarrowcastProgress(ctx context.Context, requestId string) (NarrowcastProgress, error) {
+
+	var progress NarrowcastProgress
+
+	req, err := c.newRequest(ctx, "message/progress/narrowcast", "GET", "message/progress/narrowcast?requestId="+url.QueryEscape(requestId), nil)
+
+	if err != nil {
+		return progress, err
+	}
+
+	body, _, err := c.do(req)
+
+	if err != nil {
+		return progress, err
+	}
+
+	err = json.Unmarshal(body, &progress)
+
+	return progress, err
+}
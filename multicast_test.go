@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestClientSendNarrowcastMessage(t *testing.T) {
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	// LINE accepts narrowcasts asynchronously
+	s.respond("message/narrowcast", http.StatusAccepted, `{}`)
+
+	requestId, err := s.client().SendNarrowcastMessage(context.Background(), Narrowcast{
+		Messages:  []ReplyMessage{{Type: "text", Text: "Hello"}},
+		Recipient: &Recipient{Type: "audience", AudienceGroupId: 1234},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if requestId != "test-request-id" {
+		t.Errorf("request ID = %q, want test-request-id", requestId)
+	}
+
+	// An accepted narrowcast is not sent again
+	if n := len(s.RequestsTo("message/narrowcast")); n != 1 {
+		t.Errorf("got %d narrowcast requests, want 1", n)
+	}
+}
+
+func TestClientSendMulticastMessageSplitsRecipients(t *testing.T) {
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	toIds := make([]string, 1200)
+
+	for i := range toIds {
+		toIds[i] = fmt.Sprintf("U%d", i)
+	}
+
+	requestIds, err := s.client().SendMulticastMessage(context.Background(), []ReplyMessage{{Type: "text", Text: "Hello"}}, toIds)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := s.RequestsTo("message/multicast")
+
+	if len(requests) != 3 || len(requestIds) != 3 {
+		t.Fatalf("got %d requests and %d request IDs, want 3", len(requests), len(requestIds))
+	}
+
+	var sent []string
+
+	for i, want := range []int{500, 500, 200} {
+
+		var multicast Multicast
+		requests[i].decode(t, &multicast)
+
+		if len(multicast.ToIds) != want {
+			t.Errorf("request %d has %d recipients, want %d", i, len(multicast.ToIds), want)
+		}
+
+		sent = append(sent, multicast.ToIds...)
+	}
+
+	if fmt.Sprint(sent) != fmt.Sprint(toIds) {
+		t.Error("recipients were not sent in order, each exactly once")
+	}
+}
+
+// A client whose monthly budget has the given number of messages left
+func quotaTestClient(s *fakeLINEServer, limit int, used int) *Client {
+
+	s.respond("message/quota", http.StatusOK, fmt.Sprintf(`{"type": "limited", "value": %d}`, limit))
+	s.respond("message/quota/consumption", http.StatusOK, fmt.Sprintf(`{"totalUsage": %d}`, used))
+
+	c := s.client()
+	c.Quota = NewQuotaTracker(0, false)
+
+	return c
+}
+
+func TestClientBroadcastAndNarrowcastQuota(t *testing.T) {
+
+	messages := []ReplyMessage{{Type: "text", Text: "Hello"}}
+
+	tests := []struct {
+		name    string
+		used    int
+		send    func(c *Client) error
+		wantErr error
+	}{
+		{
+			name: "broadcast with budget left",
+			used: 99,
+			send: func(c *Client) error {
+				_, err := c.SendBroadcastMessage(context.Background(), messages)
+				return err
+			},
+		},
+		{
+			name: "broadcast with the budget used up",
+			used: 100,
+			send: func(c *Client) error {
+				_, err := c.SendBroadcastMessage(context.Background(), messages)
+				return err
+			},
+			wantErr: ErrQuotaExceeded,
+		},
+		{
+			name: "narrowcast with the budget used up",
+			used: 100,
+			send: func(c *Client) error {
+				_, err := c.SendNarrowcastMessage(context.Background(), Narrowcast{Messages: messages})
+				return err
+			},
+			wantErr: ErrQuotaExceeded,
+		},
+		{
+			name: "narrowcast limited to the budget left",
+			used: 90,
+			send: func(c *Client) error {
+				_, err := c.SendNarrowcastMessage(context.Background(), Narrowcast{Messages: messages, Limit: &NarrowcastLimit{Max: 10}})
+				return err
+			},
+		},
+		{
+			name: "narrowcast limited to more than the budget left",
+			used: 90,
+			send: func(c *Client) error {
+				_, err := c.SendNarrowcastMessage(context.Background(), Narrowcast{Messages: messages, Limit: &NarrowcastLimit{Max: 11}})
+				return err
+			},
+			wantErr: ErrQuotaExceeded,
+		},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			s := newFakeLINEServer()
+			defer s.Close()
+
+			if err := tt.send(quotaTestClient(s, 100, tt.used)); err != tt.wantErr {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+
+			sent := len(s.RequestsTo("message/broadcast")) + len(s.RequestsTo("message/narrowcast"))
+
+			if (sent > 0) != (tt.wantErr == nil) {
+				t.Errorf("sent %d requests", sent)
+			}
+		})
+	}
+}
+
+// The reservation of a chunk that fails to send is given back
+func TestClientSendMulticastMessageRefundsFailedChunks(t *testing.T) {
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	c := quotaTestClient(s, 1000, 0)
+	s.respond("message/multicast", http.StatusBadRequest, `{"message": "bad request"}`)
+
+	toIds := make([]string, 600)
+
+	for i := range toIds {
+		toIds[i] = fmt.Sprintf("U%d", i)
+	}
+
+	if _, err := c.SendMulticastMessage(context.Background(), []ReplyMessage{{Type: "text", Text: "Hello"}}, toIds); err == nil {
+		t.Fatal("failed multicast returned no error")
+	}
+
+	// The whole budget is still available
+	if !c.Quota.reserve(context.Background(), c, 1000) {
+		t.Error("the failed chunk's messages were not refunded")
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Version of the postback data format. Data of other versions is rejected.
+const postbackVersion string = "1"
+
+// LINE accepts at most 300 characters of postback data
+const maxPostbackDataLength int = 300
+
+// Bytes of the HMAC kept in the signature, to leave room for the parameters
+const postbackSignatureSize int = 16
+
+// Parameters of the postback data that are used by the format itself
+const (
+	postbackVersionParam   = "v"
+	postbackActionParam    = "a"
+	postbackSourceParam    = "c"
+	postbackSignatureParam = "s"
+)
+
+var (
+	ErrUnsignedPostback         = errors.New("postback data is not signed")
+	ErrInvalidPostbackSignature = errors.New("postback data has an invalid signature")
+	ErrPostbackSourceMismatch   = errors.New("postback data was sent to another user, group or room")
+)
+
+// Key used to sign postback data if neither POSTBACK_SECRET nor the channel secret is set.
+// Postback data signed with it is only valid until the bot restarts.
+var fallbackPostbackKey = []byte(randomHex(32))
+
+// The action of a postback and its parameters, such as the number of the zombie the user ran
+// away from. Encoded in the postback data as a signed query string, e.g.
+// v=1&a=run&c=<user ID>&zombie=2&s=<signature>
+type PostbackData struct {
+	Action string
+	Params url.Values
+
+	// The user, group or room the data was sent to, so that it can't be used by anyone else
+	Source string
+}
+
+func (cfg *Config) postbackKey() []byte {
+
+	if cfg.PostbackSecret != "" {
+		return []byte(cfg.PostbackSecret)
+	}
+
+	return fallbackPostbackKey
+}
+
+func signPostback(key []byte, payload string) string {
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:postbackSignatureSize])
+}
+
+// Encode and sign postback data, so that the bot can trust it when the postback comes back
+func EncodePostback(key []byte, p PostbackData) (string, error) {
+
+	if p.Action == "" {
+		return "", errors.New("postback data has no action")
+	}
+
+	values := url.Values{}
+
+	for name, v := range p.Params {
+
+		if name == postbackVersionParam || name == postbackActionParam || name == postbackSourceParam || name == postbackSignatureParam {
+			return "", fmt.Errorf("postback parameter name %q is reserved", name)
+		}
+
+		values[name] = v
+	}
+
+	values.Set(postbackVersionParam, postbackVersion)
+	values.Set(postbackActionParam, p.Action)
+
+	if p.Source != "" {
+		values.Set(postbackSourceParam, p.Source)
+	}
+
+	// Encode sorts the parameters, so the same data always has the same signature
+	payload := values.Encode()
+	data := payload + "&" + postbackSignatureParam + "=" + signPostback(key, payload)
+
+	if len(data) > maxPostbackDataLength {
+		return "", fmt.Errorf("postback data for %s is %d characters long, the limit is %d", p.Action, len(data), maxPostbackDataLength)
+	}
+
+	return data, nil
+}
+
+// Decode postback data and verify its signature
+func DecodePostback(key []byte, data string) (PostbackData, error) {
+
+	values, err := url.ParseQuery(data)
+
+	if err != nil {
+		return PostbackData{}, fmt.Errorf("invalid postback data: %v", err)
+	}
+
+	signature := values.Get(postbackSignatureParam)
+
+	if signature == "" {
+		return PostbackData{}, ErrUnsignedPostback
+	}
+
+	values.Del(postbackSignatureParam)
+
+	if !hmac.Equal([]byte(signature), []byte(signPostback(key, values.Encode()))) {
+		return PostbackData{}, ErrInvalidPostbackSignature
+	}
+
+	if version := values.Get(postbackVersionParam); version != postbackVersion {
+		return PostbackData{}, fmt.Errorf("unsupported postback data version: %q", version)
+	}
+
+	p := PostbackData{Action: values.Get(postbackActionParam), Source: values.Get(postbackSourceParam)}
+
+	values.Del(postbackVersionParam)
+	values.Del(postbackActionParam)
+	values.Del(postbackSourceParam)
+
+	p.Params = values
+
+	return p, nil
+}
+
+// Encode and sign postback data with the bot's key, for the user, group or room of the source
+func (b *Bot) EncodePostback(source Source, action string, params url.Values) (string, error) {
+	return EncodePostback(b.Config.postbackKey(), PostbackData{Action: action, Params: params, Source: source.chatId()})
+}
+
+// Decode the data of a postback event, and check that it was sent to where the event came from
+func (b *Bot) DecodePostback(e Event) (PostbackData, error) {
+
+	p, err := DecodePostback(b.Config.postbackKey(), e.Postback.Data)
+
+	if err != nil {
+		return PostbackData{}, err
+	}
+
+	if p.Source != e.Source.chatId() {
+		return PostbackData{}, ErrPostbackSourceMismatch
+	}
+
+	return p, nil
+}
+
+// Modes of datetime picker actions
+const (
+	DatetimePickerDate     = "date"
+	DatetimePickerTime     = "time"
+	DatetimePickerDatetime = "datetime"
+)
+
+// How the values of each datetime picker mode are formatted. LINE sends and expects them
+// without a time zone, in the user's local time.
+var datetimePickerLayouts = map[string]string{
+	DatetimePickerDate:     "2006-01-02",
+	DatetimePickerTime:     "15:04",
+	DatetimePickerDatetime: "2006-01-02T15:04",
+}
+
+// Create a datetime picker action. The picked value is sent back in a postback event with the
+// given data. Zero times leave the initial, max or min value unset.
+func NewDatetimePickerAction(label string, data string, mode string, initial time.Time, min time.Time, max time.Time) (TemplateAction, error) {
+
+	layout, ok := datetimePickerLayouts[mode]
+
+	if !ok {
+		return TemplateAction{}, fmt.Errorf("unknown datetime picker mode: %s", mode)
+	}
+
+	format := func(t time.Time) string {
+
+		if t.IsZero() {
+			return ""
+		}
+
+		return t.Format(layout)
+	}
+
+	return TemplateAction{
+		Type:    "datetimepicker",
+		Label:   label,
+		Data:    data,
+		Mode:    mode,
+		Initial: format(initial),
+		Min:     format(min),
+		Max:     format(max),
+	}, nil
+}
+
+// Extra information sent with postback events of datetime picker and rich menu switch actions
+type PostbackParams struct {
+	// The value picked with a datetime picker action. Only the field of the action's mode is set.
+	Date     string `json:"date,omitempty"`
+	Time     string `json:"time,omitempty"`
+	Datetime string `json:"datetime,omitempty"`
+
+	// The rich menu that was switched to, and whether switching succeeded
+	NewRichMenuAliasId string `json:"newRichMenuAliasId,omitempty"`
+	Status             string `json:"status,omitempty"`
+}
+
+// The mode of the datetime picker the value was picked with, or "" if the postback didn't
+// come from a datetime picker
+func (p PostbackParams) PickerMode() string {
+
+	switch {
+	case p.Datetime != "":
+		return DatetimePickerDatetime
+	case p.Date != "":
+		return DatetimePickerDate
+	case p.Time != "":
+		return DatetimePickerTime
+	}
+
+	return ""
+}
+
+// The value picked with a datetime picker, in the given location since LINE doesn't send a
+// time zone. Values picked in time mode are on January 1st of year 0.
+func (p PostbackParams) PickedTime(loc *time.Location) (time.Time, error) {
+
+	mode := p.PickerMode()
+
+	value := map[string]string{
+		DatetimePickerDate:     p.Date,
+		DatetimePickerTime:     p.Time,
+		DatetimePickerDatetime: p.Datetime,
+	}[mode]
+
+	if mode == "" {
+		return time.Time{}, fmt.Errorf("postback has no datetime picker value")
+	}
+
+	t, err := time.ParseInLocation(datetimePickerLayouts[mode], value, loc)
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s picked: %v", mode, err)
+	}
+
+	return t, nil
+}
+
+// Variables for scenario replies to the postback
+func (p PostbackParams) variables() map[string]string {
+
+	return map[string]string{
+		"date":               p.Date,
+		"time":               p.Time,
+		"datetime":           p.Datetime,
+		"newRichMenuAliasId": p.NewRichMenuAliasId,
+		"status":             p.Status,
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewDatetimePickerAction(t *testing.T) {
+
+	tokyo := time.FixedZone("JST", 9*60*60)
+	initial := time.Date(2026, 10, 18, 9, 30, 0, 0, tokyo)
+
+	tests := []struct {
+		mode        string
+		initial     time.Time
+		wantInitial string
+		wantErr     bool
+	}{
+		{mode: DatetimePickerDate, initial: initial, wantInitial: "2026-10-18"},
+		{mode: DatetimePickerTime, initial: initial, wantInitial: "09:30"},
+		{mode: DatetimePickerDatetime, initial: initial, wantInitial: "2026-10-18T09:30"},
+
+		// Times are shown in their own location
+		{mode: DatetimePickerDatetime, initial: initial.UTC(), wantInitial: "2026-10-18T00:30"},
+		{mode: DatetimePickerDatetime},
+		{mode: "week", wantErr: true},
+	}
+
+	for _, tt := range tests {
+
+		action, err := NewDatetimePickerAction("Pick", "data", tt.mode, tt.initial, time.Time{}, time.Time{})
+
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error: %v", tt.mode, err, tt.wantErr)
+			continue
+		}
+
+		if tt.wantErr {
+			continue
+		}
+
+		if action.Type != "datetimepicker" || action.Mode != tt.mode || action.Data != "data" {
+			t.Errorf("%s: action = %+v", tt.mode, action)
+		}
+
+		if action.Initial != tt.wantInitial || action.Min != "" || action.Max != "" {
+			t.Errorf("%s: initial = %q, min = %q, max = %q, want initial %q", tt.mode, action.Initial, action.Min, action.Max, tt.wantInitial)
+		}
+	}
+}
+
+func TestPostbackParamsPickedTime(t *testing.T) {
+
+	tokyo := time.FixedZone("JST", 9*60*60)
+
+	tests := []struct {
+		params   PostbackParams
+		wantMode string
+		want     time.Time
+		wantErr  bool
+	}{
+		{params: PostbackParams{Date: "2026-10-18"}, wantMode: DatetimePickerDate, want: time.Date(2026, 10, 18, 0, 0, 0, 0, tokyo)},
+		{params: PostbackParams{Time: "09:30"}, wantMode: DatetimePickerTime, want: time.Date(0, 1, 1, 9, 30, 0, 0, tokyo)},
+		{params: PostbackParams{Datetime: "2026-10-18T09:30"}, wantMode: DatetimePickerDatetime, want: time.Date(2026, 10, 18, 9, 30, 0, 0, tokyo)},
+		{params: PostbackParams{Datetime: "tomorrow"}, wantMode: DatetimePickerDatetime, wantErr: true},
+		{params: PostbackParams{NewRichMenuAliasId: "menu"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+
+		if mode := tt.params.PickerMode(); mode != tt.wantMode {
+			t.Errorf("%+v: mode = %q, want %q", tt.params, mode, tt.wantMode)
+		}
+
+		got, err := tt.params.PickedTime(tokyo)
+
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%+v: err = %v, want error: %v", tt.params, err, tt.wantErr)
+			continue
+		}
+
+		if !tt.wantErr && !got.Equal(tt.want) {
+			t.Errorf("%+v: picked %v, want %v", tt.params, got, tt.want)
+		}
+	}
+}
+
+// The picker offers times in the bot's time zone
+func TestScheduleZombieAttackCommandUsesTheTimeZone(t *testing.T) {
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	tokyo := time.FixedZone("JST", 9*60*60)
+
+	cfg := testConfig()
+	cfg.TimeZone = tokyo
+
+	b, err := NewBot(cfg, s.client(), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now().In(tokyo).Format(datetimePickerLayouts[DatetimePickerDatetime])
+
+	if err := ScheduleZombieAttackCommand(context.Background(), b, Event{ReplyToken: "reply-token"}, Message{}); err != nil {
+		t.Fatal(err)
+	}
+
+	after := time.Now().In(tokyo).Format(datetimePickerLayouts[DatetimePickerDatetime])
+
+	requests := s.RequestsTo("message/reply")
+
+	if len(requests) != 1 {
+		t.Fatalf("got %d replies, want 1", len(requests))
+	}
+
+	body := string(requests[0].Body)
+
+	if !strings.Contains(body, `"min":"`+before+`"`) && !strings.Contains(body, `"min":"`+after+`"`) {
+		t.Errorf("reply %s doesn't offer times from %s in the bot's time zone", body, before)
+	}
+}
+
+func TestEncodeDecodePostback(t *testing.T) {
+
+	key := []byte("test-secret")
+
+	signed, err := EncodePostback(key, PostbackData{Action: "run", Params: url.Values{"zombie": {"2"}}, Source: "U123"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if signed != "a=run&c=U123&v=1&zombie=2&s="+signPostback(key, "a=run&c=U123&v=1&zombie=2") {
+		t.Errorf("encoded data = %q", signed)
+	}
+
+	// Data signed with a different key, or changed after signing
+	otherKey, _ := EncodePostback([]byte("other-secret"), PostbackData{Action: "run"})
+	tampered := strings.Replace(signed, "zombie=2", "zombie=3", 1)
+	unversioned := "a=run&s=" + signPostback(key, "a=run")
+
+	tests := []struct {
+		name    string
+		data    string
+		want    PostbackData
+		wantErr error
+	}{
+		{name: "signed", data: signed, want: PostbackData{Action: "run", Params: url.Values{"zombie": {"2"}}, Source: "U123"}},
+		{name: "unsigned", data: "run", wantErr: ErrUnsignedPostback},
+		{name: "other key", data: otherKey, wantErr: ErrInvalidPostbackSignature},
+		{name: "tampered", data: tampered, wantErr: ErrInvalidPostbackSignature},
+		{name: "forged signature", data: "a=run&v=1&s=AAAAAAAAAAAAAAAAAAAAAA", wantErr: ErrInvalidPostbackSignature},
+		{name: "unsupported version", data: unversioned},
+		{name: "not a query string", data: "a=%zz"},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			got, err := DecodePostback(key, tt.data)
+
+			if tt.want.Action == "" {
+
+				if err == nil {
+					t.Fatalf("DecodePostback(%q) = %+v, want an error", tt.data, got)
+				}
+
+				if tt.wantErr != nil && err != tt.wantErr {
+					t.Errorf("err = %v, want %v", err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decoded %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodePostbackErrors(t *testing.T) {
+
+	key := []byte("test-secret")
+
+	tests := []struct {
+		name string
+		data PostbackData
+	}{
+		{"no action", PostbackData{}},
+		{"reserved parameter", PostbackData{Action: "run", Params: url.Values{"s": {"x"}}}},
+		{"too long", PostbackData{Action: "run", Params: url.Values{"zombie": {strings.Repeat("z", maxPostbackDataLength)}}}},
+	}
+
+	for _, tt := range tests {
+
+		if data, err := EncodePostback(key, tt.data); err == nil {
+			t.Errorf("%s: encoded %q, want an error", tt.name, data)
+		}
+	}
+}
+
+// Signed data only works in the chat it was sent to
+func TestBotDecodePostbackChecksTheSource(t *testing.T) {
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	b := s.bot(t)
+
+	user := Source{Type: "user", UserId: "U123"}
+	group := Source{Type: "group", GroupId: "G123", UserId: "U123"}
+
+	tests := []struct {
+		name    string
+		sentTo  Source
+		from    Source
+		wantErr error
+	}{
+		{"same user", user, user, nil},
+		{"other user", user, Source{Type: "user", UserId: "U456"}, ErrPostbackSourceMismatch},
+		{"other member of the group", group, Source{Type: "group", GroupId: "G123", UserId: "U456"}, nil},
+		{"from the group to a user", group, user, ErrPostbackSourceMismatch},
+	}
+
+	for _, tt := range tests {
+
+		data, err := b.EncodePostback(tt.sentTo, "run", nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = b.DecodePostback(Event{Source: tt.from, Postback: Postback{Data: data}})
+
+		if err != tt.wantErr {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// The default scenario leaves the zombie commands to the built-in handlers, so the run postback
+// says which zombie the user ran from
+func TestDefaultScenarioPostbacks(t *testing.T) {
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	scenario, err := LoadScenario(defaultScenarioFile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBot(testConfig(), s.client(), scenario)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := Source{Type: "user", UserId: "U123"}
+
+	multizombie := Event{Type: "message", ReplyToken: "reply-token", Source: user, Message: json.RawMessage(`{"id": "1", "type": "text", "text": "multizombie"}`)}
+
+	if err := ProcessEvent(context.Background(), b, multizombie); err != nil {
+		t.Fatal(err)
+	}
+
+	replies := s.replies(t)
+
+	if len(replies) != 1 || len(replies[0][0].Template.Columns) != 3 {
+		t.Fatalf("replies = %+v", replies)
+	}
+
+	data := replies[0][0].Template.Columns[1].Actions[0].Data
+
+	run := Event{Type: "postback", ReplyToken: "reply-token", Source: user, Postback: Postback{Data: data}}
+
+	if err := ProcessEvent(context.Background(), b, run); err != nil {
+		t.Fatal(err)
+	}
+
+	if replies := s.replies(t); len(replies) != 2 || !strings.Contains(replies[1][0].Text, "Zombie 2") {
+		t.Errorf("run replies = %+v, want a reply about Zombie 2", replies)
+	}
+}
+
+// Scenario postbacks are signed when they are sent, and only accepted back from the same user
+func TestScenarioPostbacks(t *testing.T) {
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	scenario, err := loadTestScenario(t, `{
+		"commands": [{"name": "dare", "trigger": "exact", "pattern": "dare", "replies": [{
+			"type": "template",
+			"altText": "Dare",
+			"template": {"type": "confirm", "text": "Do you dare?", "actions": [
+				{"type": "postback", "label": "Yes", "data": "{{postback:dare}}"},
+				{"type": "message", "label": "No", "text": "No"}
+			]}
+		}]}],
+		"postbacks": [{"action": "dare", "replies": [{"type": "text", "text": "You took the {{action}}!"}]}]
+	}`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBot(testConfig(), s.client(), scenario)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := Source{Type: "user", UserId: "U123"}
+
+	dare := Event{Type: "message", ReplyToken: "reply-token", Source: user, Message: json.RawMessage(`{"id": "1", "type": "text", "text": "dare"}`)}
+
+	if err := ProcessEvent(context.Background(), b, dare); err != nil {
+		t.Fatal(err)
+	}
+
+	replies := s.replies(t)
+
+	if len(replies) != 1 || len(replies[0][0].Template.Actions) == 0 {
+		t.Fatalf("replies = %+v", replies)
+	}
+
+	data := replies[0][0].Template.Actions[0].Data
+
+	if p, err := b.DecodePostback(Event{Source: user, Postback: Postback{Data: data}}); err != nil || p.Action != "dare" {
+		t.Fatalf("postback data %q = %+v, %v, want a signed dare action", data, p, err)
+	}
+
+	postbacks := []struct {
+		name      string
+		source    Source
+		data      string
+		wantReply bool
+	}{
+		{"signed for the user", user, data, true},
+		{"raw action", user, "dare", false},
+		{"copied by another user", Source{Type: "user", UserId: "U456"}, data, false},
+	}
+
+	for _, tt := range postbacks {
+
+		before := len(s.replies(t))
+		e := Event{Type: "postback", ReplyToken: "reply-token", Source: tt.source, Postback: Postback{Data: tt.data}}
+
+		if err := ProcessEvent(context.Background(), b, e); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if replied := len(s.replies(t)) > before; replied != tt.wantReply {
+			t.Errorf("%s: replied = %v, want %v", tt.name, replied, tt.wantReply)
+		}
+	}
+
+	if replies := s.replies(t); replies[1][0].Text != "You took the dare!" {
+		t.Errorf("postback reply = %q", replies[1][0].Text)
+	}
+}
+
+// Postback data contains the chat's ID, so it is redacted like the IDs
+func TestPostbackDataIsRedacted(t *testing.T) {
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	b := s.bot(t)
+
+	user := Source{Type: "user", UserId: "U123"}
+
+	data, err := b.EncodePostback(user, "run", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	ctx := withLogger(context.Background(), NewLogger(&logs, LevelDebug, defaultRedactions))
+
+	for _, from := range []Source{user, {Type: "user", UserId: "U456"}} {
+
+		if err := ProcessPostbackEvent(ctx, b, Event{Type: "postback", ReplyToken: "reply-token", Source: from, Postback: Postback{Data: data}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if strings.Contains(logs.String(), "U123") || !strings.Contains(logs.String(), `"action":"run"`) {
+		t.Errorf("logs = %s", logs.String())
+	}
+
+	if _, err := b.EncodePostback(user, "run", url.Values{"long": {strings.Repeat("x", maxPostbackDataLength)}}); err == nil || strings.Contains(err.Error(), "U123") {
+		t.Errorf("EncodePostback of long data = %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Register the handlers of the postbacks sent by the bot's templates
+func registerDefaultPostbacks(r *PostbackRouter) error {
+
+	handlers := map[string]PostbackHandler{
+		"run":           RunPostback,
+		"noexplode":     NoExplodePostback,
+		"zombie_attack": ZombieAttackPostback,
+	}
+
+	for action, handler := range handlers {
+
+		if err := r.Register(action, handler); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Postback sent when the user runs from a zombie. The zombie parameter is the number of the
+// zombie in the carousel, if the user ran from one of those.
+func RunPostback(ctx context.Context, b *Bot, e Event, p PostbackData) error {
+
+	rand.Seed((time.Now().UTC().UnixNano()))
+
+	coinFlip := rand.Intn(100000)
+
+	loggerFrom(ctx).Debug("Flipped a coin", "coinFlip", coinFlip)
+
+	zombie := "the zombie"
+
+	if number := p.Params.Get("zombie"); number != "" {
+		zombie = "Zombie " + number
+	}
+
+	if coinFlip%2 == 0 {
+
+		replyMessage1 := ReplyMessage{
+			Text: "I got your run postback... and your were able to escape from " + zombie + "!!",
+			Type: "text",
+		}
+
+		image_url := b.Config.staticUrl("run.jpg")
+		preview_image_url := b.Config.staticUrl("p_run.jpg")
+
+		replyMessage2 := ReplyMessage{
+			Type:               "image",
+			OriginalContentUrl: image_url,
+			PreviewImageUrl:    preview_image_url,
+		}
+
+		err := b.Client.SendReplyMessage(ctx, e.ReplyToken, []ReplyMessage{replyMessage1, replyMessage2})
+
+		if err != nil {
+			return err
+		}
+
+		return nil
+
+	} else {
+
+		replyMessage1 := ReplyMessage{
+			Text: "I got your run postback... and " + zombie + " got you! Now you must EXPLODE!",
+			Type: "text",
+		}
+
+		image_url := b.Config.staticUrl("explode.jpg")
+		preview_image_url := b.Config.staticUrl("p_explode.jpg")
+
+		replyMessage2 := ReplyMessage{
+			Type:               "image",
+			OriginalContentUrl: image_url,
+			PreviewImageUrl:    preview_image_url,
+		}
+
+		err := b.Client.SendReplyMessage(ctx, e.ReplyToken, []ReplyMessage{replyMessage1, replyMessage2})
+
+		if err != nil {
+			return err
+		}
+
+		return nil
+
+	}
+}
+
+// Postback sent when the user picks when the zombies attack
+func ZombieAttackPostback(ctx context.Context, b *Bot, e Event, p PostbackData) error {
+
+	attackTime, err := e.Postback.Params.PickedTime(b.Config.TimeZone)
+
+	if err != nil {
+		return err
+	}
+
+	replyMessage1 := ReplyMessage{
+		Text: "The zombies will attack on " + attackTime.Format("Monday, January 2 at 15:04") + "! Get ready!!",
+		Type: "text",
+	}
+
+	err = b.Client.SendReplyMessage(ctx, e.ReplyToken, []ReplyMessage{replyMessage1})
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Postback sent when the user doesn't want to explode
+func NoExplodePostback(ctx context.Context, b *Bot, e Event, p PostbackData) error {
+
+	replyMessage1 := ReplyMessage{
+		Text: "I got a postback saying that you do not want to explode... and I think you are a coward!",
+		Type: "text",
+	}
+
+	replyMessage2 := ReplyMessage{
+		Type:      "sticker",
+		StickerId: "527",
+		PackageId: "2",
+	}
+
+	err := b.Client.SendReplyMessage(ctx, e.ReplyToken, []ReplyMessage{replyMessage1, replyMessage2})
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
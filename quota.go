@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const defaultQuotaRefreshInterval time.Duration = 10 * time.Minute
+const defaultMaxQueuedPushes int = 1000
+
+var ErrQuotaExceeded = errors.New("monthly message budget has been reached")
+
+type MessageQuota struct {
+	Type  string `json:"type,omitempty"`
+	Value int64  `json:"value,omitempty"`
+}
+
+type MessageQuotaConsumption struct {
+	TotalUsage int64 `json:"totalUsage"`
+}
+
+// Keeps track of how many messages the bot has sent this month, so that pushes can be
+// refused or queued before LINE starts rejecting them.
+type QuotaTracker struct {
+	// Max number of messages the bot may send per month. Zero means only LINE's own quota applies.
+	Budget int64
+
+	// If true, pushes over the budget are queued and sent once the budget allows it again.
+	// Otherwise they are refused with ErrQuotaExceeded.
+	QueueWhenExhausted bool
+	MaxQueued          int
+
+	// How often the quota and consumption are re-read from LINE
+	RefreshInterval time.Duration
+
+	mu        sync.Mutex
+	limit     int64 // -1 means unlimited
+	consumed  int64
+	refreshed time.Time
+	queue     []PushMessage
+}
+
+func NewQuotaTracker(budget int64, queueWhenExhausted bool) *QuotaTracker {
+
+	return &QuotaTracker{
+		Budget:             budget,
+		QueueWhenExhausted: queueWhenExhausted,
+		MaxQueued:          defaultMaxQueuedPushes,
+		RefreshInterval:    defaultQuotaRefreshInterval,
+		limit:              -1,
+	}
+}
+
+// Re-read the monthly quota and consumption from LINE
+func (q *QuotaTracker) refresh(ctx context.Context, c *Client) error {
+
+	quota, err := c.GetMessageQuota(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	consumption, err := c.GetMessageQuotaConsumption(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	limit := int64(-1)
+
+	if quota.Type == "limited" {
+		limit = quota.Value
+	}
+
+	if q.Budget > 0 && (limit < 0 || q.Budget < limit) {
+		limit = q.Budget
+	}
+
+	q.mu.Lock()
+	q.limit = limit
+	q.consumed = consumption.TotalUsage
+	q.refreshed = time.Now()
+	q.mu.Unlock()
+
+	c.logger(ctx).Info("Message quota refreshed", "used", consumption.TotalUsage, "limit", limit)
+
+	return nil
+}
+
+// Reserve n messages from the budget. Returns false if that would exceed the budget.
+func (q *QuotaTracker) reserve(ctx context.Context, c *Client, n int64) bool {
+
+	q.mu.Lock()
+	stale := time.Since(q.refreshed) > q.RefreshInterval
+	q.mu.Unlock()
+
+	if stale {
+
+		// If LINE can't be reached, carry on with the last known numbers
+		if err := q.refresh(ctx, c); err != nil {
+			c.logger(ctx).Warn("Failed to refresh message quota", "error", err)
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.limit >= 0 && q.consumed+n > q.limit {
+		return false
+	}
+
+	q.consumed += n
+
+	return true
+}
+
+// Give back messages that were reserved but not sent
+func (q *QuotaTracker) refund(n int64) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.consumed -= n
+
+	if q.consumed < 0 {
+		q.consumed = 0
+	}
+}
+
+// Whether the budget has been used up. Used for broadcasts and narrowcasts, whose number of
+// recipients isn't known in advance.
+func (q *QuotaTracker) exhausted(ctx context.Context, c *Client) bool {
+
+	// Reserving nothing refreshes the numbers if they are stale
+	q.reserve(ctx, c, 0)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.limit >= 0 && q.consumed >= q.limit
+}
+
+// Re-read the consumption from LINE before the next reservation, after sending messages whose
+// number isn't known
+func (q *QuotaTracker) invalidate() {
+
+	q.mu.Lock()
+	q.refreshed = time.Time{}
+	q.mu.Unlock()
+}
+
+// Queue a push to be sent later. Returns false if queueing is disabled or the queue is full.
+func (q *QuotaTracker) enqueue(p PushMessage) bool {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.QueueWhenExhausted || len(q.queue) >= q.MaxQueued {
+		return false
+	}
+
+	q.queue = append(q.queue, p)
+
+	return true
+}
+
+// Send as many queued pushes as the budget allows
+func (q *QuotaTracker) flush(ctx context.Context, c *Client) {
+
+	for {
+
+		q.mu.Lock()
+
+		if len(q.queue) == 0 {
+			q.mu.Unlock()
+			return
+		}
+
+		p := q.queue[0]
+		q.mu.Unlock()
+
+		if !q.reserve(ctx, c, 1) {
+			return
+		}
+
+		q.mu.Lock()
+		q.queue = q.queue[1:]
+		q.mu.Unlock()
+
+		if err := c.sendPush(ctx, p); err != nil {
+			c.logger(ctx).Warn("Failed to send queued push message", "error", err)
+		}
+	}
+}
+
+// Periodically refresh the quota and send queued pushes until the context is done
+func (q *QuotaTracker) Run(ctx context.Context, c *Client) {
+
+	ticker := time.NewTicker(q.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+
+		select {
+
+		case <-ctx.Done():
+
+			return
+
+		case <-ticker.C:
+
+			if err := q.refresh(ctx, c); err != nil {
+				c.logger(ctx).Warn("Failed to refresh message quota", "error", err)
+				continue
+			}
+
+			q.flush(ctx, c)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A rate limit for one API endpoint. Rate is in requests per second.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// Default limits, based on the rate limits documented for the Messaging API
+var defaultRateLimits = map[string]RateLimit{
+	"message/reply":      {Rate: 2000, Burst: 2000},
+	"message/push":       {Rate: 2000, Burst: 2000},
+	"message/multicast":  {Rate: 200, Burst: 200},
+	"message/broadcast":  {Rate: 60.0 / 3600, Burst: 1},
+	"message/narrowcast": {Rate: 60.0 / 3600, Burst: 1},
+}
+
+// Limit used for endpoints that have no limit of their own
+var defaultRateLimit = RateLimit{Rate: 2000, Burst: 2000}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// Take a token from the bucket and return how long the caller has to wait before using it
+func (b *tokenBucket) reserve() time.Duration {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	b.last = now
+
+	if burst := float64(b.limit.Burst); b.tokens > burst {
+		b.tokens = burst
+	}
+
+	b.tokens--
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.limit.Rate * float64(time.Second))
+}
+
+// Give back a token that was reserved but never used
+func (b *tokenBucket) cancel() {
+
+	b.mu.Lock()
+	b.tokens++
+	b.mu.Unlock()
+}
+
+// Token bucket rate limiter with a separate bucket per API endpoint.
+// A single limiter is shared by every call made through a Client.
+type RateLimiter struct {
+	mu      sync.Mutex
+	limits  map[string]RateLimit
+	buckets map[string]*tokenBucket
+}
+
+// Create a rate limiter. Endpoints without an entry in limits use the defaults.
+func NewRateLimiter(limits map[string]RateLimit) *RateLimiter {
+
+	merged := make(map[string]RateLimit)
+
+	for endpoint, limit := range defaultRateLimits {
+		merged[endpoint] = limit
+	}
+
+	for endpoint, limit := range limits {
+		merged[endpoint] = limit
+	}
+
+	return &RateLimiter{
+		limits:  merged,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (l *RateLimiter) bucket(endpoint string) *tokenBucket {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[endpoint]
+
+	if !ok {
+
+		limit, ok := l.limits[endpoint]
+
+		if !ok {
+			limit = defaultRateLimit
+		}
+
+		b = &tokenBucket{
+			limit:  limit,
+			tokens: float64(limit.Burst),
+			last:   time.Now(),
+		}
+
+		l.buckets[endpoint] = b
+	}
+
+	return b
+}
+
+// Block until a request to the endpoint is allowed or the context is done
+func (l *RateLimiter) Wait(ctx context.Context, endpoint string) error {
+
+	b := l.bucket(endpoint)
+
+	if b.limit.Rate <= 0 {
+		return nil
+	}
+
+	delay := b.reserve()
+
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+
+	case <-ctx.Done():
+
+		b.cancel()
+		return ctx.Err()
+
+	case <-timer.C:
+
+		return nil
+	}
+}
+
+// Parse a list of rate limits such as "message/push=100/s:200,message/broadcast=60/h".
+// Each entry is endpoint=count/unit with an optional burst size, where unit is s, m or h.
+func ParseRateLimits(value string) (map[string]RateLimit, error) {
+
+	limits := make(map[string]RateLimit)
+
+	for _, entry := range strings.Split(value, ",") {
+
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rate limit %q: expected endpoint=count/unit", entry)
+		}
+
+		spec := parts[1]
+		burst := 0
+
+		if i := strings.Index(spec, ":"); i >= 0 {
+
+			var err error
+
+			if burst, err = strconv.Atoi(spec[i+1:]); err != nil || burst < 1 {
+				return nil, fmt.Errorf("invalid burst in rate limit %q", entry)
+			}
+
+			spec = spec[:i]
+		}
+
+		rateParts := strings.SplitN(spec, "/", 2)
+
+		if len(rateParts) != 2 {
+			return nil, fmt.Errorf("invalid rate limit %q: expected endpoint=count/unit", entry)
+		}
+
+		count, err := strconv.ParseFloat(rateParts[0], 64)
+
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("invalid count in rate limit %q", entry)
+		}
+
+		var per time.Duration
+
+		switch rateParts[1] {
+		case "s":
+			per = time.Second
+		case "m":
+			per = time.Minute
+		case "h":
+			per = time.Hour
+		default:
+			return nil, fmt.Errorf("invalid unit in rate limit %q: must be s, m or h", entry)
+		}
+
+		if burst == 0 {
+
+			burst = int(count)
+
+			if burst < 1 {
+				burst = 1
+			}
+		}
+
+		limits[strings.TrimSpace(parts[0])] = RateLimit{
+			Rate:  count / per.Seconds(),
+			Burst: burst,
+		}
+	}
+
+	return limits, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimits(t *testing.T) {
+
+	tests := []struct {
+		value   string
+		want    map[string]RateLimit
+		wantErr bool
+	}{
+		{value: "", want: map[string]RateLimit{}},
+		{value: "message/push=100/s", want: map[string]RateLimit{"message/push": {Rate: 100, Burst: 100}}},
+		{value: "message/push=100/s:200", want: map[string]RateLimit{"message/push": {Rate: 100, Burst: 200}}},
+		{value: "message/multicast=120/m", want: map[string]RateLimit{"message/multicast": {Rate: 2, Burst: 120}}},
+		{value: "message/broadcast=0.5/h", want: map[string]RateLimit{"message/broadcast": {Rate: 0.5 / 3600, Burst: 1}}},
+		{
+			value: " message/push=10/s , message/reply=20/s:5 ",
+			want: map[string]RateLimit{
+				"message/push":  {Rate: 10, Burst: 10},
+				"message/reply": {Rate: 20, Burst: 5},
+			},
+		},
+		{value: "message/push", wantErr: true},
+		{value: "message/push=100", wantErr: true},
+		{value: "message/push=fast/s", wantErr: true},
+		{value: "message/push=-1/s", wantErr: true},
+		{value: "message/push=100/d", wantErr: true},
+		{value: "message/push=100/s:0", wantErr: true},
+		{value: "message/push=100/s:many", wantErr: true},
+	}
+
+	for _, tt := range tests {
+
+		got, err := ParseRateLimits(tt.value)
+
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRateLimits(%q) error = %v, want error: %v", tt.value, err, tt.wantErr)
+			continue
+		}
+
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseRateLimits(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+
+	b := &tokenBucket{limit: RateLimit{Rate: 10, Burst: 2}, tokens: 2, last: time.Now()}
+
+	// The burst is available at once
+	for i := 0; i < 2; i++ {
+
+		if d := b.reserve(); d != 0 {
+			t.Fatalf("reserve %d waited %v, want 0", i, d)
+		}
+	}
+
+	// Then tokens come in at the rate, one every 100ms
+	if d := b.reserve(); d <= 0 || d > 100*time.Millisecond {
+		t.Errorf("third reserve waited %v, want up to 100ms", d)
+	}
+
+	if d := b.reserve(); d <= 100*time.Millisecond || d > 200*time.Millisecond {
+		t.Errorf("fourth reserve waited %v, want 100-200ms", d)
+	}
+
+	// A cancelled reservation gives its token back
+	b.cancel()
+
+	if d := b.reserve(); d <= 100*time.Millisecond || d > 200*time.Millisecond {
+		t.Errorf("reserve after cancel waited %v, want 100-200ms", d)
+	}
+}
+
+func TestTokenBucketRefillsUpToBurst(t *testing.T) {
+
+	b := &tokenBucket{limit: RateLimit{Rate: 10, Burst: 2}, tokens: 0, last: time.Now().Add(-time.Hour)}
+
+	for i := 0; i < 2; i++ {
+
+		if d := b.reserve(); d != 0 {
+			t.Fatalf("reserve %d waited %v, want 0", i, d)
+		}
+	}
+
+	if d := b.reserve(); d == 0 {
+		t.Error("reserve beyond the burst didn't wait")
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+
+	l := NewRateLimiter(map[string]RateLimit{"message/push": {Rate: 1, Burst: 1}})
+
+	if err := l.Wait(context.Background(), "message/push"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other endpoints have buckets of their own
+	if err := l.Wait(context.Background(), "message/reply"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := l.Wait(ctx, "message/push"); err != context.DeadlineExceeded {
+		t.Errorf("Wait on an empty bucket = %v, want the context's error", err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const defaultReloadPollInterval time.Duration = 5 * time.Second
+
+// Holds the active bots and replaces them when their config or scenario files change or the process receives SIGHUP.
+// Each webhook request uses the bot that was active when it arrived, so requests that are
+// in flight during a reload finish with the old routing table.
+type Reloader struct {
+	PollInterval time.Duration
+
+	current atomic.Value
+	load    func() (Bots, error)
+
+	mu       sync.Mutex
+	fileInfo map[string]watchedFile
+	lastErr  error
+}
+
+// Last seen state of a watched file. A file that doesn't exist has a zero value.
+type watchedFile struct {
+	modTime time.Time
+	size    int64
+}
+
+// Create a reloader. The bots are loaded once immediately, and an error is returned if that fails.
+func NewReloader(load func() (Bots, error)) (*Reloader, error) {
+
+	r := &Reloader{
+		PollInterval: defaultReloadPollInterval,
+		load:         load,
+		fileInfo:     make(map[string]watchedFile),
+	}
+
+	bots, err := load()
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.current.Store(bots)
+	r.changedFiles()
+
+	return r, nil
+}
+
+// The currently active bots
+func (r *Reloader) Bots() Bots {
+	return r.current.Load().(Bots)
+}
+
+// The currently active bot for the channel, or nil if the channel is not served
+func (r *Reloader) Bot(channelId string) *Bot {
+	return r.Bots()[channelId]
+}
+
+// The error of the last reload, or nil if it succeeded
+func (r *Reloader) LastError() error {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.lastErr
+}
+
+// Load the bots again and make them the active ones. If loading fails, the old bots stay active.
+func (r *Reloader) Reload() error {
+
+	bots, err := r.load()
+
+	r.mu.Lock()
+	r.lastErr = err
+	r.mu.Unlock()
+
+	if err != nil {
+		rootLogger.Error("Reload failed, keeping the current configuration", "error", err)
+		return err
+	}
+
+	r.current.Store(bots)
+
+	rootLogger.Info("Reloaded bot configuration")
+
+	return nil
+}
+
+// Return the files of the active bots that changed since the last call
+func (r *Reloader) changedFiles() []string {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var changed []string
+
+	for _, path := range r.Bots().watchedFiles() {
+
+		var info watchedFile
+
+		if fi, err := os.Stat(path); err == nil {
+			info = watchedFile{modTime: fi.ModTime(), size: fi.Size()}
+		}
+
+		if previous, ok := r.fileInfo[path]; ok && previous != info {
+			changed = append(changed, path)
+		}
+
+		r.fileInfo[path] = info
+	}
+
+	return changed
+}
+
+// Reload whenever a watched file changes or SIGHUP is received, until the context is done
+func (r *Reloader) Watch(ctx context.Context) {
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	ticker := time.NewTicker(r.PollInterval)
+	defer ticker.Stop()
+
+	for {
+
+		select {
+
+		case <-ctx.Done():
+
+			return
+
+		case <-hangup:
+
+			rootLogger.Info("Received SIGHUP, reloading")
+			r.changedFiles()
+			r.Reload()
+
+		case <-ticker.C:
+
+			if changed := r.changedFiles(); len(changed) > 0 {
+				rootLogger.Info("Watched files changed, reloading", "files", changed)
+				r.Reload()
+			}
+		}
+	}
+}
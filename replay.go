@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// How far event timestamps may be from the current time by default
+const defaultWebhookMaxSkew time.Duration = 5 * time.Minute
+
+// How old redelivered events may be by default
+const defaultWebhookMaxRedeliveryAge time.Duration = 24 * time.Hour
+
+var ErrStaleWebhook = errors.New("webhook event timestamp is outside the allowed window")
+var ErrReplayedWebhook = errors.New("webhook body was already received")
+
+// Rejects signed webhook bodies that are replayed, either because their events are too old or
+// because the same body was received recently
+type ReplayGuard struct {
+	MaxSkew time.Duration
+
+	// Redelivered events keep the timestamp of the original delivery, so they may be older
+	MaxRedeliveryAge time.Duration
+
+	bodies IdempotencyStore
+
+	// Number of rejected requests, by reason
+	staleRejections    int64
+	replayedRejections int64
+}
+
+func NewReplayGuard(maxSkew time.Duration, maxRedeliveryAge time.Duration) *ReplayGuard {
+
+	// A body only has to be remembered for as long as its events would pass the timestamp check
+	window := 2 * maxSkew
+
+	if maxRedeliveryAge+maxSkew > window {
+		window = maxRedeliveryAge + maxSkew
+	}
+
+	return &ReplayGuard{
+		MaxSkew:          maxSkew,
+		MaxRedeliveryAge: maxRedeliveryAge,
+		bodies:           NewMemoryIdempotencyStore(window),
+	}
+}
+
+// Check a verified webhook body and its events. The body is remembered if it is accepted.
+func (g *ReplayGuard) Check(body []byte, events []*Event) error {
+
+	now := time.Now()
+
+	for _, event := range events {
+
+		if event == nil {
+			continue
+		}
+
+		oldest := now.Add(-g.MaxSkew)
+
+		// Redelivered events may be older, and the body check covers them for that long
+		if event.DeliveryContext.IsRedelivery && g.MaxRedeliveryAge > g.MaxSkew {
+			oldest = now.Add(-g.MaxRedeliveryAge)
+		}
+
+		timestamp := time.Unix(0, event.Timestamp*int64(time.Millisecond))
+
+		if timestamp.Before(oldest) || timestamp.After(now.Add(g.MaxSkew)) {
+			atomic.AddInt64(&g.staleRejections, 1)
+			return ErrStaleWebhook
+		}
+	}
+
+	// Webhooks without events, such as the one sent when verifying the webhook URL, can't
+	// trigger anything when replayed
+	if len(events) == 0 {
+		return nil
+	}
+
+	ok, err := g.bodies.Claim(bodyHash(body))
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		atomic.AddInt64(&g.replayedRejections, 1)
+		return ErrReplayedWebhook
+	}
+
+	return nil
+}
+
+// Forget a body that was accepted but could not be handled
+func (g *ReplayGuard) Forget(body []byte) {
+	g.bodies.Release(bodyHash(body))
+}
+
+// Number of requests rejected because their events were too old or too far in the future,
+// and because their body was already received
+func (g *ReplayGuard) Rejections() (int64, int64) {
+	return atomic.LoadInt64(&g.staleRejections), atomic.LoadInt64(&g.replayedRejections)
+}
+
+func bodyHash(body []byte) string {
+
+	sum := sha256.Sum256(body)
+
+	return hex.EncodeToString(sum[:])
+}
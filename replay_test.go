@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func replayTestEvent(age time.Duration, redelivery bool) *Event {
+
+	e := &Event{Type: "message", Timestamp: time.Now().Add(-age).UnixNano() / int64(time.Millisecond)}
+	e.DeliveryContext.IsRedelivery = redelivery
+
+	return e
+}
+
+func TestReplayGuardCheck(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		events  []*Event
+		wantErr error
+	}{
+		{name: "no events"},
+		{name: "recent event", events: []*Event{replayTestEvent(time.Minute, false)}},
+		{name: "old event", events: []*Event{replayTestEvent(10*time.Minute, false)}, wantErr: ErrStaleWebhook},
+		{name: "event from the future", events: []*Event{replayTestEvent(-10*time.Minute, false)}, wantErr: ErrStaleWebhook},
+		{name: "old redelivered event", events: []*Event{replayTestEvent(time.Hour, true)}},
+		{name: "redelivered event that is too old", events: []*Event{replayTestEvent(25*time.Hour, true)}, wantErr: ErrStaleWebhook},
+		{name: "redelivered event from the future", events: []*Event{replayTestEvent(-10*time.Minute, true)}, wantErr: ErrStaleWebhook},
+		{
+			name:    "one old event rejects the webhook",
+			events:  []*Event{replayTestEvent(0, false), replayTestEvent(time.Hour, false)},
+			wantErr: ErrStaleWebhook,
+		},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			g := NewReplayGuard(5*time.Minute, 24*time.Hour)
+			body := []byte(tt.name)
+
+			if err := g.Check(body, tt.events); err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr != nil || len(tt.events) == 0 {
+				return
+			}
+
+			// The same body can't be accepted twice
+			if err := g.Check(body, tt.events); err != ErrReplayedWebhook {
+				t.Errorf("replayed body err = %v, want ErrReplayedWebhook", err)
+			}
+
+			// Unless it could not be handled
+			g.Forget(body)
+
+			if err := g.Check(body, tt.events); err != nil {
+				t.Errorf("forgotten body err = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestReplayGuardRejections(t *testing.T) {
+
+	g := NewReplayGuard(5*time.Minute, 24*time.Hour)
+	events := []*Event{replayTestEvent(0, false)}
+
+	g.Check([]byte("a"), []*Event{replayTestEvent(time.Hour, false)})
+	g.Check([]byte("b"), events)
+	g.Check([]byte("b"), events)
+
+	if stale, replayed := g.Rejections(); stale != 1 || replayed != 1 {
+		t.Errorf("rejections = %d stale, %d replayed, want 1 and 1", stale, replayed)
+	}
+}
+
+// Bodies are remembered for as long as their redelivered events would be accepted
+func TestReplayGuardRemembersBodiesForRedeliveries(t *testing.T) {
+
+	g := NewReplayGuard(time.Minute, 24*time.Hour)
+
+	if g.bodies.(*MemoryIdempotencyStore).ttl < 24*time.Hour {
+		t.Errorf("bodies are remembered for %v, want at least 24h", g.bodies.(*MemoryIdempotencyStore).ttl)
+	}
+}
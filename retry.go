@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"time"
+)
+
+// Controls how requests that fail with a transient error are retried
+type RetryPolicy struct {
+	// Total number of attempts, including the first one. Values below 1 disable retrying.
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+}
+
+// Returns how long to wait before the given retry (starting at 1).
+// The delay grows exponentially and half of it is randomized so that clients do not retry in lockstep.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+
+	delay := p.BaseDelay << uint(retry-1)
+
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	half := delay / 2
+
+	return half + time.Duration(mathrand.Int63n(int64(half)+1))
+}
+
+// Returns true if a request that failed with this error may succeed if it is sent again
+func isRetryableError(err error) bool {
+
+	var apiErr *APIError
+
+	if errors.As(err, &apiErr) {
+		return apiErr.IsRetryable()
+	}
+
+	// Anything else is a transport error
+	return true
+}
+
+// Generate a random (version 4) UUID, used as X-Line-Retry-Key and as correlation ID in logs
+func newUUID() (string, error) {
+
+	var b [16]byte
+
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// Send a request built by newReq, retrying transient failures according to the client's retry policy.
+// Every attempt carries the same X-Line-Retry-Key so that LINE only accepts the request once.
+// A 409 response means an earlier attempt was already accepted, so it is treated as success.
+func (c *Client) doWithRetry(ctx context.Context, newReq func() (*http.Request, error)) ([]byte, http.Header, error) {
+
+	retryKey, err := newUUID()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+
+		req, err := newReq()
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		req.Header.Set("X-Line-Retry-Key", retryKey)
+
+		body, header, err := c.do(req)
+
+		if err == nil {
+			return body, header, nil
+		}
+
+		var apiErr *APIError
+
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+
+			c.logger(ctx).Info("Request with retry key was already accepted", "retryKey", retryKey, "lineRequestId", apiErr.AcceptedRequestId)
+
+			// Report the ID of the request that was accepted in place of this one
+			header := http.Header{}
+			header.Set("X-Line-Request-Id", apiErr.AcceptedRequestId)
+
+			return nil, header, nil
+		}
+
+		if attempt >= c.RetryPolicy.MaxAttempts || !isRetryableError(err) || ctx.Err() != nil {
+			return nil, nil, err
+		}
+
+		delay := c.RetryPolicy.backoff(attempt)
+
+		// Honour the server's Retry-After if it asks us to wait longer
+		if apiErr != nil && apiErr.RetryAfter > delay {
+			delay = apiErr.RetryAfter
+		}
+
+		c.logger(ctx).Warn("LINE API call failed, retrying", "attempt", attempt, "error", err, "delay", delay, "retryKey", retryKey)
+		apiRetries.Inc(endpointFromContext(req.Context()))
+
+		timer := time.NewTimer(delay)
+
+		select {
+
+		case <-ctx.Done():
+
+			timer.Stop()
+			return nil, nil, ctx.Err()
+
+		case <-timer.C:
+
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDoWithRetry(t *testing.T) {
+
+	tests := []struct {
+		name string
+
+		// Status codes of the responses, in order. The last one repeats.
+		codes     []int
+		header    http.Header
+		wantErr   bool
+		wantCalls int
+		wantWait  time.Duration
+		wantReqId string
+	}{
+		{name: "success", codes: []int{200}, wantCalls: 1},
+		{name: "retries server errors", codes: []int{500, 502, 200}, wantCalls: 3},
+		{name: "retries rate limits", codes: []int{429, 200}, wantCalls: 2},
+		{name: "gives up after max attempts", codes: []int{500}, wantErr: true, wantCalls: 3},
+		{name: "does not retry client errors", codes: []int{400}, wantErr: true, wantCalls: 1},
+		{
+			name:      "conflict means an earlier attempt was accepted",
+			codes:     []int{500, 409},
+			header:    http.Header{"X-Line-Accepted-Request-Id": {"accepted-id"}},
+			wantCalls: 2,
+			wantReqId: "accepted-id",
+		},
+		{
+			name:      "honours Retry-After",
+			codes:     []int{429, 200},
+			header:    http.Header{"Retry-After": {"1"}},
+			wantCalls: 2,
+			wantWait:  time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			s := newFakeLINEServer()
+			defer s.Close()
+
+			var calls int32
+
+			s.handle("message/push", func(w http.ResponseWriter, r *http.Request) {
+
+				call := int(atomic.AddInt32(&calls, 1))
+				code := tt.codes[len(tt.codes)-1]
+
+				if call <= len(tt.codes) {
+					code = tt.codes[call-1]
+				}
+
+				for name, values := range tt.header {
+					w.Header()[name] = values
+				}
+
+				w.WriteHeader(code)
+				w.Write([]byte("{}"))
+			})
+
+			c := s.client()
+			start := time.Now()
+
+			_, header, err := c.postJSONWithRetry(context.Background(), "message/push", PushMessage{ToId: "U123"})
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+
+			if int(calls) != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+
+			if waited := time.Since(start); waited < tt.wantWait {
+				t.Errorf("waited %v, want at least %v", waited, tt.wantWait)
+			}
+
+			if tt.wantReqId != "" && header.Get("X-Line-Request-Id") != tt.wantReqId {
+				t.Errorf("request ID = %q, want %q", header.Get("X-Line-Request-Id"), tt.wantReqId)
+			}
+
+			// Every attempt carries the same retry key
+			keys := make(map[string]bool)
+
+			for _, r := range s.RequestsTo("message/push") {
+				keys[r.Header.Get("X-Line-Retry-Key")] = true
+			}
+
+			if len(keys) != 1 || keys[""] {
+				t.Errorf("retry keys = %v, want one key", keys)
+			}
+		})
+	}
+}
+
+func TestDoWithRetryStopsWhenCancelled(t *testing.T) {
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	s.respond("message/push", http.StatusInternalServerError, `{"message": "boom"}`)
+
+	c := s.client()
+	c.RetryPolicy = RetryPolicy{MaxAttempts: 10, BaseDelay: time.Hour, MaxDelay: time.Hour}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, _, err := c.postJSONWithRetry(ctx, "message/push", PushMessage{ToId: "U123"})
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the context's error", err)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+
+	p := RetryPolicy{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	tests := []struct {
+		retry    int
+		min, max time.Duration
+	}{
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{2, 100 * time.Millisecond, 200 * time.Millisecond},
+		{3, 200 * time.Millisecond, 400 * time.Millisecond},
+		{10, 500 * time.Millisecond, time.Second},
+	}
+
+	for _, tt := range tests {
+
+		for i := 0; i < 20; i++ {
+
+			if d := p.backoff(tt.retry); d < tt.min || d > tt.max {
+				t.Errorf("backoff(%d) = %v, want between %v and %v", tt.retry, d, tt.min, tt.max)
+			}
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How a command's pattern is matched against the text of a message. All matching is case insensitive.
+type TriggerType int
+
+const (
+	// The whole message must equal the pattern
+	TriggerExact TriggerType = iota
+	// The message must start with the pattern
+	TriggerPrefix
+	// The pattern is a regular expression that must match somewhere in the message
+	TriggerRegex
+	// The pattern must appear in the message as whole words
+	TriggerKeyword
+)
+
+type CommandHandler func(ctx context.Context, b *Bot, e Event, m Message) error
+
+type Command struct {
+	Name        string
+	Description string
+	Trigger     TriggerType
+	Pattern     string
+
+	// Commands with a higher priority are tried first. Commands with the same priority are tried in registration order.
+	Priority int
+
+	// Source types ("user", "group", "room") the command is available in. Empty means all of them.
+	Sources []string
+
+	Handler CommandHandler
+
+	regex *regexp.Regexp
+}
+
+// Returns true if the command can be used from the given source type
+func (cmd *Command) availableIn(sourceType string) bool {
+
+	if len(cmd.Sources) == 0 {
+		return true
+	}
+
+	for _, s := range cmd.Sources {
+
+		if s == sourceType {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (cmd *Command) matches(text string) bool {
+
+	switch cmd.Trigger {
+	case TriggerExact:
+		return strings.EqualFold(strings.TrimSpace(text), cmd.Pattern)
+	case TriggerPrefix:
+		return strings.HasPrefix(strings.ToLower(strings.TrimSpace(text)), strings.ToLower(cmd.Pattern))
+	default:
+		return cmd.regex.MatchString(text)
+	}
+}
+
+// Routes text messages to the registered command that matches them
+type CommandRouter struct {
+	mu       sync.RWMutex
+	commands []*Command
+}
+
+func NewCommandRouter() *CommandRouter {
+	return &CommandRouter{}
+}
+
+// Add a command to the router. A command with the same name as an existing one replaces it.
+func (r *CommandRouter) Register(cmd Command) error {
+
+	if cmd.Handler == nil {
+		return fmt.Errorf("command %q has no handler", cmd.Name)
+	}
+
+	var err error
+
+	switch cmd.Trigger {
+	case TriggerExact, TriggerPrefix:
+	case TriggerRegex:
+		cmd.regex, err = regexp.Compile("(?i)" + cmd.Pattern)
+	case TriggerKeyword:
+		cmd.regex, err = regexp.Compile(`(?i)\b` + regexp.QuoteMeta(cmd.Pattern) + `\b`)
+	default:
+		err = fmt.Errorf("unknown trigger type %d", cmd.Trigger)
+	}
+
+	if err != nil {
+		return fmt.Errorf("command %q: %v", cmd.Name, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, existing := range r.commands {
+
+		if existing.Name == cmd.Name {
+			r.commands = append(r.commands[:i], r.commands[i+1:]...)
+			break
+		}
+	}
+
+	r.commands = append(r.commands, &cmd)
+
+	sort.SliceStable(r.commands, func(i, j int) bool {
+		return r.commands[i].Priority > r.commands[j].Priority
+	})
+
+	return nil
+}
+
+// Find the command that should handle the text, or nil if there is none
+func (r *CommandRouter) Match(text string, sourceType string) *Command {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, cmd := range r.commands {
+
+		if cmd.availableIn(sourceType) && cmd.matches(text) {
+			return cmd
+		}
+	}
+
+	return nil
+}
+
+// Run the command matching the message, if any. Returns false if no command matched.
+func (r *CommandRouter) Dispatch(ctx context.Context, b *Bot, e Event, m Message) (bool, error) {
+
+	cmd := r.Match(m.Text, e.Source.Type)
+
+	if cmd == nil {
+		return false, nil
+	}
+
+	loggerFrom(ctx).Info("Dispatching message to command", "command", cmd.Name)
+
+	return true, cmd.run(ctx, b, e, m)
+}
+
+// Find the command with the given name, or nil if there is none
+func (r *CommandRouter) Lookup(name string) *Command {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, cmd := range r.commands {
+
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+
+	return nil
+}
+
+// Run the command with the given name, for events that aren't messages. Returns false if there
+// is no such command. Commands that aren't available in the event's chat are skipped.
+func (r *CommandRouter) Run(ctx context.Context, b *Bot, e Event, name string, m Message) (bool, error) {
+
+	cmd := r.Lookup(name)
+
+	if cmd == nil {
+		return false, nil
+	}
+
+	// Commands such as goodbye only make sense in some chats, however they are triggered
+	if !cmd.availableIn(e.Source.Type) {
+		loggerFrom(ctx).Info("Command isn't available in this chat", "command", cmd.Name, "sourceType", e.Source.Type)
+		return true, nil
+	}
+
+	loggerFrom(ctx).Info("Running command", "command", cmd.Name)
+
+	return true, cmd.run(ctx, b, e, m)
+}
+
+func (cmd *Command) run(ctx context.Context, b *Bot, e Event, m Message) error {
+
+	start := time.Now()
+
+	err := trace(ctx, "command", func(ctx context.Context) error {
+		return cmd.Handler(ctx, b, e, m)
+	}, "command", cmd.Name)
+
+	commandDuration.Observe(time.Since(start).Seconds(), cmd.Name)
+
+	return err
+}
+
+// Build the text of the help reply, listing the commands available from the given source type
+func (r *CommandRouter) HelpText(sourceType string) string {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	lines := []string{"Here is what I can do:"}
+
+	for _, cmd := range r.commands {
+
+		if !cmd.availableIn(sourceType) || cmd.Description == "" {
+			continue
+		}
+
+		usage := cmd.Pattern
+
+		if cmd.Trigger == TriggerRegex {
+			usage = cmd.Name
+		}
+
+		lines = append(lines, fmt.Sprintf("\"%s\" - %s", usage, cmd.Description))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+type PostbackHandler func(ctx context.Context, b *Bot, e Event, p PostbackData) error
+
+// Routes postbacks to the handler registered for their action
+type PostbackRouter struct {
+	mu       sync.RWMutex
+	handlers map[string]PostbackHandler
+}
+
+func NewPostbackRouter() *PostbackRouter {
+	return &PostbackRouter{handlers: make(map[string]PostbackHandler)}
+}
+
+// Add a handler for the action. A handler for the same action replaces the existing one.
+func (r *PostbackRouter) Register(action string, handler PostbackHandler) error {
+
+	if action == "" || handler == nil {
+		return fmt.Errorf("postback handler for %q needs an action and a handler", action)
+	}
+
+	r.mu.Lock()
+	r.handlers[action] = handler
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Run the handler of the postback's action, if any. Returns false if there is no handler.
+func (r *PostbackRouter) Dispatch(ctx context.Context, b *Bot, e Event, p PostbackData) (bool, error) {
+
+	r.mu.RLock()
+	handler, ok := r.handlers[p.Action]
+	r.mu.RUnlock()
+
+	if !ok {
+		return false, nil
+	}
+
+	loggerFrom(ctx).Info("Dispatching postback to handler", "action", p.Action, "params", p.Params)
+
+	start := time.Now()
+
+	err := trace(ctx, "postback", func(ctx context.Context) error {
+		return handler(ctx, b, e, p)
+	}, "action", p.Action)
+
+	postbackDuration.Observe(time.Since(start).Seconds(), p.Action)
+
+	return true, err
+}
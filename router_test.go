@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func noopCommand(ctx context.Context, b *Bot, e Event, m Message) error {
+	return nil
+}
+
+func TestCommandRouterMatch(t *testing.T) {
+
+	r := NewCommandRouter()
+
+	commands := []Command{
+		{Name: "help", Trigger: TriggerExact, Pattern: "help", Priority: 100},
+		{Name: "say", Trigger: TriggerPrefix, Pattern: "say "},
+		{Name: "dice", Trigger: TriggerRegex, Pattern: `^roll \d+d\d+$`},
+		{Name: "zombie", Trigger: TriggerKeyword, Pattern: "zombie", Priority: 10},
+		{Name: "find zombie", Trigger: TriggerKeyword, Pattern: "find zombie", Priority: 20},
+		{Name: "first", Trigger: TriggerKeyword, Pattern: "tie", Priority: 5},
+		{Name: "second", Trigger: TriggerKeyword, Pattern: "tie", Priority: 5},
+		{Name: "goodbye", Trigger: TriggerKeyword, Pattern: "goodbye", Sources: []string{"group", "room"}},
+	}
+
+	for _, cmd := range commands {
+
+		cmd.Handler = noopCommand
+
+		if err := r.Register(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		text       string
+		sourceType string
+		want       string
+	}{
+		// Exact
+		{"help", "user", "help"},
+		{"  HELP ", "user", "help"},
+		{"help me", "user", ""},
+
+		// Prefix
+		{"say hello", "user", "say"},
+		{"Say hello", "user", "say"},
+		{"please say hello", "user", ""},
+
+		// Regex, case insensitive
+		{"roll 2d6", "user", "dice"},
+		{"ROLL 2D6", "user", "dice"},
+		{"roll dice", "user", ""},
+
+		// Keywords are whole words
+		{"a zombie!", "user", "zombie"},
+		{"multizombie", "user", ""},
+		{"zombies", "user", ""},
+
+		// Higher priority first, then registration order
+		{"find zombie", "user", "find zombie"},
+		{"tie", "user", "first"},
+
+		// Commands limited to some sources
+		{"goodbye", "group", "goodbye"},
+		{"goodbye", "room", "goodbye"},
+		{"goodbye", "user", ""},
+	}
+
+	for _, tt := range tests {
+
+		got := ""
+
+		if cmd := r.Match(tt.text, tt.sourceType); cmd != nil {
+			got = cmd.Name
+		}
+
+		if got != tt.want {
+			t.Errorf("Match(%q, %q) = %q, want %q", tt.text, tt.sourceType, got, tt.want)
+		}
+	}
+}
+
+// "multizombie" used to trigger "find zombie" as well
+func TestDefaultCommands(t *testing.T) {
+
+	r := NewCommandRouter()
+
+	if err := registerDefaultCommands(r); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text       string
+		sourceType string
+		want       string
+	}{
+		{"multizombie", "user", "multizombie"},
+		{"find zombie", "user", "find zombie"},
+		{"let's find zombie", "user", "find zombie"},
+		{"schedule zombie attack", "user", "schedule zombie attack"},
+		{"imagemap", "user", "imagemap"},
+		{"help", "user", "help"},
+		{"goodbye", "user", ""},
+		{"goodbye", "group", "goodbye"},
+		{"zombie", "user", ""},
+	}
+
+	for _, tt := range tests {
+
+		got := ""
+
+		if cmd := r.Match(tt.text, tt.sourceType); cmd != nil {
+			got = cmd.Name
+		}
+
+		if got != tt.want {
+			t.Errorf("Match(%q, %q) = %q, want %q", tt.text, tt.sourceType, got, tt.want)
+		}
+	}
+}
+
+func TestCommandRouterRegister(t *testing.T) {
+
+	r := NewCommandRouter()
+
+	if err := r.Register(Command{Name: "broken", Trigger: TriggerRegex, Pattern: "(", Handler: noopCommand}); err == nil {
+		t.Error("invalid regex was accepted")
+	}
+
+	if err := r.Register(Command{Name: "nohandler", Trigger: TriggerExact, Pattern: "x"}); err == nil {
+		t.Error("command without a handler was accepted")
+	}
+
+	// A command with the same name replaces the existing one
+	r.Register(Command{Name: "hello", Trigger: TriggerExact, Pattern: "hello", Handler: noopCommand})
+	r.Register(Command{Name: "hello", Trigger: TriggerExact, Pattern: "hi", Handler: noopCommand})
+
+	if r.Match("hello", "user") != nil || r.Match("hi", "user") == nil {
+		t.Error("command was not replaced")
+	}
+}
+
+func TestCommandRouterHelpText(t *testing.T) {
+
+	r := NewCommandRouter()
+
+	commands := []Command{
+		{Name: "help", Description: "Shows this", Trigger: TriggerExact, Pattern: "help", Priority: 100},
+		{Name: "dice", Description: "Rolls dice", Trigger: TriggerRegex, Pattern: `^roll \d+d\d+$`},
+		{Name: "goodbye", Description: "Leaves the group", Trigger: TriggerKeyword, Pattern: "goodbye", Sources: []string{"group", "room"}},
+		{Name: "hidden", Trigger: TriggerKeyword, Pattern: "hidden"},
+	}
+
+	for _, cmd := range commands {
+
+		cmd.Handler = noopCommand
+		r.Register(cmd)
+	}
+
+	// Commands without a description are not listed
+	tests := []struct {
+		sourceType string
+		want       string
+	}{
+		{"user", "Here is what I can do:\n\"help\" - Shows this\n\"dice\" - Rolls dice"},
+		{"group", "Here is what I can do:\n\"help\" - Shows this\n\"dice\" - Rolls dice\n\"goodbye\" - Leaves the group"},
+	}
+
+	for _, tt := range tests {
+
+		if got := r.HelpText(tt.sourceType); got != tt.want {
+			t.Errorf("HelpText(%q) =\n%s\nwant\n%s", tt.sourceType, got, tt.want)
+		}
+	}
+}
+
+// Commands limited to some sources aren't run for events from other chats, e.g. a beacon mapped to goodbye
+func TestCommandRouterRunSources(t *testing.T) {
+
+	r := NewCommandRouter()
+
+	calls := 0
+
+	err := r.Register(Command{Name: "goodbye", Trigger: TriggerKeyword, Pattern: "goodbye", Sources: []string{"group", "room"}, Handler: func(ctx context.Context, b *Bot, e Event, m Message) error {
+		calls++
+		return nil
+	}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		sourceType string
+		calls      int
+	}{
+		{"user", 0},
+		{"group", 1},
+		{"room", 2},
+	}
+
+	for _, tt := range tests {
+
+		found, err := r.Run(context.Background(), nil, Event{Source: Source{Type: tt.sourceType}}, "goodbye", Message{})
+
+		if !found || err != nil {
+			t.Errorf("Run from %s = %v, %v", tt.sourceType, found, err)
+		}
+
+		if calls != tt.calls {
+			t.Errorf("after running from %s, goodbye ran %d times, want %d", tt.sourceType, calls, tt.calls)
+		}
+	}
+
+	if found, _ := r.Run(context.Background(), nil, Event{}, "missing", Message{}); found {
+		t.Error("unknown command was found")
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"regexp"
+)
+
+// Default location of the scenario file, used if SCENARIO_FILE is not set
+const defaultScenarioFile string = "scenarios/default.json"
+
+// A scenario describes how the bot replies to commands, postbacks and events without any Go code.
+// Replies are written in the same JSON format as the messages sent to the Messaging API and may
+// contain variables such as {{displayName}} or {{BOT_HOST}}, and signed postback data such as
+// {{postback:run}}.
+type Scenario struct {
+	Commands  []ScenarioCommand          `json:"commands"`
+	Postbacks []ScenarioPostback         `json:"postbacks"`
+	Events    map[string]ScenarioReplies `json:"events"`
+}
+
+// The messages sent in reply. If Alternatives is set, one of them is picked at random instead.
+type ScenarioReplies struct {
+	Replies      []json.RawMessage   `json:"replies,omitempty"`
+	Alternatives [][]json.RawMessage `json:"alternatives,omitempty"`
+}
+
+type ScenarioCommand struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Trigger     string   `json:"trigger"`
+	Pattern     string   `json:"pattern"`
+	Priority    int      `json:"priority,omitempty"`
+	Sources     []string `json:"sources,omitempty"`
+	ScenarioReplies
+}
+
+// Replies to the postbacks of an action, such as the ones sent with {{postback:run}}
+type ScenarioPostback struct {
+	Action string `json:"action"`
+	ScenarioReplies
+}
+
+var triggerTypes = map[string]TriggerType{
+	"exact":   TriggerExact,
+	"prefix":  TriggerPrefix,
+	"regex":   TriggerRegex,
+	"keyword": TriggerKeyword,
+}
+
+// Matches variables such as {{displayName}}
+var scenarioVariable = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+// Matches postback data such as {{postback:run}}, which is replaced with signed data for the action
+var scenarioPostback = regexp.MustCompile(`\{\{\s*postback:(\w+)\s*\}\}`)
+
+// Load the scenario file from the config. Returns nil if no scenario file was configured and
+// the default one doesn't exist.
+func LoadScenarioFromConfig(cfg *Config) (*Scenario, error) {
+
+	if !cfg.ScenarioRequired {
+
+		if _, err := os.Stat(cfg.ScenarioFile); err != nil {
+			return nil, nil
+		}
+	}
+
+	return LoadScenario(cfg.ScenarioFile)
+}
+
+// Read and validate a scenario file
+func LoadScenario(path string) (*Scenario, error) {
+
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var s Scenario
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&s); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if err := s.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return &s, nil
+}
+
+func (s *Scenario) validate() error {
+
+	for i, cmd := range s.Commands {
+
+		if cmd.Name == "" || cmd.Pattern == "" {
+			return fmt.Errorf("commands[%d]: name and pattern are required", i)
+		}
+
+		if _, ok := triggerTypes[cmd.Trigger]; !ok {
+			return fmt.Errorf("command %q: unknown trigger %q", cmd.Name, cmd.Trigger)
+		}
+
+		if cmd.Trigger == "regex" {
+
+			if _, err := regexp.Compile(cmd.Pattern); err != nil {
+				return fmt.Errorf("command %q: %v", cmd.Name, err)
+			}
+		}
+
+		if err := cmd.ScenarioReplies.validate(); err != nil {
+			return fmt.Errorf("command %q: %v", cmd.Name, err)
+		}
+	}
+
+	for i, p := range s.Postbacks {
+
+		if p.Action == "" {
+			return fmt.Errorf("postbacks[%d]: action is required", i)
+		}
+
+		if err := p.ScenarioReplies.validate(); err != nil {
+			return fmt.Errorf("postback %q: %v", p.Action, err)
+		}
+	}
+
+	for eventType, replies := range s.Events {
+
+		if err := replies.validate(); err != nil {
+			return fmt.Errorf("event %q: %v", eventType, err)
+		}
+	}
+
+	return nil
+}
+
+func (sr ScenarioReplies) validate() error {
+
+	if len(sr.Replies) == 0 && len(sr.Alternatives) == 0 {
+		return fmt.Errorf("replies or alternatives are required")
+	}
+
+	if len(sr.Replies) > 0 && len(sr.Alternatives) > 0 {
+		return fmt.Errorf("only one of replies and alternatives can be set")
+	}
+
+	lists := sr.Alternatives
+
+	if len(sr.Replies) > 0 {
+		lists = [][]json.RawMessage{sr.Replies}
+	}
+
+	for _, replies := range lists {
+
+		// LINE accepts at most 5 messages per reply
+		if len(replies) == 0 || len(replies) > 5 {
+			return fmt.Errorf("a reply must have between 1 and 5 messages")
+		}
+
+		for _, raw := range replies {
+
+			var m ReplyMessage
+
+			// Fields the bot doesn't know about would silently be dropped, so reject them
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.DisallowUnknownFields()
+
+			if err := decoder.Decode(&m); err != nil {
+				return err
+			}
+
+			if m.Type == "" {
+				return fmt.Errorf("message %s has no type", raw)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Register the scenario's commands with the router. They replace built-in commands with the same name.
+func (s *Scenario) RegisterCommands(r *CommandRouter) error {
+
+	for _, cmd := range s.Commands {
+
+		replies := cmd.ScenarioReplies
+
+		err := r.Register(Command{
+			Name:        cmd.Name,
+			Description: cmd.Description,
+			Trigger:     triggerTypes[cmd.Trigger],
+			Pattern:     cmd.Pattern,
+			Priority:    cmd.Priority,
+			Sources:     cmd.Sources,
+			Handler: func(ctx context.Context, b *Bot, e Event, m Message) error {
+				return b.replyWithScenario(ctx, e, replies, map[string]string{"text": m.Text})
+			},
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Find the replies for the postback action, if the scenario has any
+func (s *Scenario) postbackReplies(action string) (ScenarioReplies, bool) {
+
+	if s == nil {
+		return ScenarioReplies{}, false
+	}
+
+	for _, p := range s.Postbacks {
+
+		if p.Action == action {
+			return p.ScenarioReplies, true
+		}
+	}
+
+	return ScenarioReplies{}, false
+}
+
+// Find the replies for the event type, if the scenario has any
+func (s *Scenario) eventReplies(eventType string) (ScenarioReplies, bool) {
+
+	if s == nil {
+		return ScenarioReplies{}, false
+	}
+
+	replies, ok := s.Events[eventType]
+
+	return replies, ok
+}
+
+// Substitute the variables in the replies and send them using the event's reply token
+func (b *Bot) replyWithScenario(ctx context.Context, e Event, sr ScenarioReplies, vars map[string]string) error {
+
+	replies := sr.Replies
+
+	if len(sr.Alternatives) > 0 {
+		replies = sr.Alternatives[rand.Intn(len(sr.Alternatives))]
+	}
+
+	values := map[string]string{
+		"BOT_HOST":   b.Config.BotHost,
+		"STATIC_URL": b.Config.StaticAssetsUrl,
+		"userId":     e.Source.UserId,
+		"groupId":    e.Source.GroupId,
+		"roomId":     e.Source.RoomId,
+	}
+
+	for k, v := range vars {
+		values[k] = v
+	}
+
+	messages := make([]ReplyMessage, 0, len(replies))
+
+	for _, raw := range replies {
+
+		// Only look up the profile if it is actually needed
+		if _, ok := values["displayName"]; !ok && bytes.Contains(raw, []byte("displayName")) && e.Source.UserId != "" {
+
+			profile, err := b.Client.GetProfile(ctx, e.Source.UserId)
+
+			if err != nil {
+				return err
+			}
+
+			values["displayName"] = profile.DisplayName
+		}
+
+		signed, err := b.signScenarioPostbacks(e.Source, raw)
+
+		if err != nil {
+			return err
+		}
+
+		var m ReplyMessage
+
+		if err := json.Unmarshal(substituteVariables(signed, values), &m); err != nil {
+			return err
+		}
+
+		messages = append(messages, m)
+	}
+
+	return b.Client.SendReplyMessage(ctx, e.ReplyToken, messages)
+}
+
+// Replace the postback data in a JSON message with data signed for the event's source
+func (b *Bot) signScenarioPostbacks(source Source, raw json.RawMessage) ([]byte, error) {
+
+	var err error
+
+	signed := scenarioPostback.ReplaceAllFunc(raw, func(match []byte) []byte {
+
+		action := string(scenarioPostback.FindSubmatch(match)[1])
+
+		data, encodeErr := b.EncodePostback(source, action, nil)
+
+		if encodeErr != nil {
+			err = encodeErr
+			return match
+		}
+
+		// The data is a query string, which needs no escaping inside a JSON string
+		return []byte(data)
+	})
+
+	return signed, err
+}
+
+// Replace the variables in a JSON message. Values are escaped so that the result is still valid JSON.
+// Unknown variables are left as they are.
+func substituteVariables(raw json.RawMessage, values map[string]string) []byte {
+
+	return scenarioVariable.ReplaceAllFunc(raw, func(match []byte) []byte {
+
+		name := string(scenarioVariable.FindSubmatch(match)[1])
+
+		value, ok := values[name]
+
+		if !ok {
+			return match
+		}
+
+		escaped, _ := json.Marshal(value)
+
+		// Drop the surrounding quotes, the variable is already inside a JSON string
+		return escaped[1 : len(escaped)-1]
+	})
+}
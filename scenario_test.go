@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write the scenario to a temporary file and load it
+func loadTestScenario(t *testing.T, content string) (*Scenario, error) {
+
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "scenario")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "scenario.json")
+
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return LoadScenario(path)
+}
+
+func TestLoadScenario(t *testing.T) {
+
+	text := `{"type": "text", "text": "Hi"}`
+	sixTexts := strings.Repeat(text+",", 5) + text
+
+	tests := []struct {
+		name     string
+		scenario string
+		wantErr  string
+	}{
+		{
+			name:     "valid",
+			scenario: `{"commands": [{"name": "hi", "trigger": "exact", "pattern": "hi", "replies": [` + text + `]}], "events": {"follow": {"alternatives": [[` + text + `], [` + text + `]]}}}`,
+		},
+		{
+			name:     "missing pattern",
+			scenario: `{"commands": [{"name": "hi", "trigger": "exact", "replies": [` + text + `]}]}`,
+			wantErr:  "commands[0]: name and pattern are required",
+		},
+		{
+			name:     "unknown trigger",
+			scenario: `{"commands": [{"name": "hi", "trigger": "fuzzy", "pattern": "hi", "replies": [` + text + `]}]}`,
+			wantErr:  `unknown trigger "fuzzy"`,
+		},
+		{
+			name:     "bad regex",
+			scenario: `{"commands": [{"name": "hi", "trigger": "regex", "pattern": "(hi", "replies": [` + text + `]}]}`,
+			wantErr:  `command "hi": error parsing regexp`,
+		},
+		{
+			name:     "more than 5 messages",
+			scenario: `{"commands": [{"name": "hi", "trigger": "exact", "pattern": "hi", "replies": [` + sixTexts + `]}]}`,
+			wantErr:  "between 1 and 5 messages",
+		},
+		{
+			name:     "more than 5 messages in an alternative",
+			scenario: `{"events": {"follow": {"alternatives": [[` + text + `], [` + sixTexts + `]]}}}`,
+			wantErr:  "between 1 and 5 messages",
+		},
+		{
+			name:     "no replies",
+			scenario: `{"events": {"follow": {}}}`,
+			wantErr:  "replies or alternatives are required",
+		},
+		{
+			name:     "replies and alternatives",
+			scenario: `{"events": {"follow": {"replies": [` + text + `], "alternatives": [[` + text + `]]}}}`,
+			wantErr:  "only one of replies and alternatives",
+		},
+		{
+			name:     "unknown field",
+			scenario: `{"commands": [{"name": "hi", "trigger": "exact", "pattern": "hi", "reply": [` + text + `]}]}`,
+			wantErr:  `unknown field "reply"`,
+		},
+		{
+			name:     "unknown message field",
+			scenario: `{"events": {"follow": {"replies": [{"type": "text", "txt": "Hi"}]}}}`,
+			wantErr:  `unknown field "txt"`,
+		},
+		{
+			name:     "message without a type",
+			scenario: `{"events": {"follow": {"replies": [{"text": "Hi"}]}}}`,
+			wantErr:  "has no type",
+		},
+		{
+			name:     "postback without an action",
+			scenario: `{"postbacks": [{"replies": [` + text + `]}]}`,
+			wantErr:  "postbacks[0]: action is required",
+		},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			_, err := loadTestScenario(t, tt.scenario)
+
+			if tt.wantErr == "" {
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSubstituteVariables(t *testing.T) {
+
+	values := map[string]string{
+		"displayName": "Tester",
+		"text":        "say \"hi\"\nand <bye>",
+	}
+
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{`{"text": "Hi, {{displayName}}!"}`, "Hi, Tester!"},
+		{`{"text": "Hi, {{ displayName }}!"}`, "Hi, Tester!"},
+		{`{"text": "You said {{text}}"}`, "You said say \"hi\"\nand <bye>"},
+		{`{"text": "{{unknown}} stays"}`, "{{unknown}} stays"},
+		{`{"text": "{{displayName}}{{displayName}}"}`, "TesterTester"},
+	}
+
+	for _, tt := range tests {
+
+		substituted := substituteVariables(json.RawMessage(tt.raw), values)
+
+		// Values are escaped, so the result is still valid JSON
+		var m ReplyMessage
+
+		if err := json.Unmarshal(substituted, &m); err != nil {
+			t.Errorf("%s: substituted %s is not valid JSON: %v", tt.raw, substituted, err)
+			continue
+		}
+
+		if m.Text != tt.want {
+			t.Errorf("%s: text = %q, want %q", tt.raw, m.Text, tt.want)
+		}
+	}
+}
+
+func TestReplyWithScenarioAlternatives(t *testing.T) {
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	sr := ScenarioReplies{
+		Alternatives: [][]json.RawMessage{
+			{json.RawMessage(`{"type": "text", "text": "heads"}`)},
+			{json.RawMessage(`{"type": "text", "text": "tails"}`), json.RawMessage(`{"type": "text", "text": "again"}`)},
+		},
+	}
+
+	b := s.bot(t)
+	e := Event{ReplyToken: "reply-token", Source: Source{Type: "user", UserId: "U123"}}
+
+	for i := 0; i < 50; i++ {
+
+		if err := b.replyWithScenario(context.Background(), e, sr, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	picked := make(map[string]int)
+
+	for _, reply := range s.replies(t) {
+
+		picked[reply[0].Text]++
+
+		// Each alternative is sent as a whole
+		if reply[0].Text == "tails" && len(reply) != 2 {
+			t.Errorf("reply = %+v, want the whole alternative", reply)
+		}
+	}
+
+	if picked["heads"] == 0 || picked["tails"] == 0 {
+		t.Errorf("picked %v, want both alternatives", picked)
+	}
+}
+
+func TestReplyWithScenarioVariables(t *testing.T) {
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	s.respond("profile/U123", http.StatusOK, `{"displayName": "Tester"}`)
+
+	sr := ScenarioReplies{Replies: []json.RawMessage{json.RawMessage(`{"type": "text", "text": "{{displayName}} said {{text}} at {{BOT_HOST}}"}`)}}
+	e := Event{ReplyToken: "reply-token", Source: Source{Type: "user", UserId: "U123"}}
+
+	if err := s.bot(t).replyWithScenario(context.Background(), e, sr, map[string]string{"text": `"hi"`}); err != nil {
+		t.Fatal(err)
+	}
+
+	replies := s.replies(t)
+
+	if len(replies) != 1 || replies[0][0].Text != `Tester said "hi" at https://bot.example/` {
+		t.Errorf("replies = %+v", replies)
+	}
+}
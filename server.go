@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Timeouts of the HTTP server. Webhooks are small and are acknowledged before their events
+// are handled, so the server doesn't have to wait long for anything.
+const serverReadHeaderTimeout time.Duration = 10 * time.Second
+const serverReadTimeout time.Duration = 30 * time.Second
+const serverWriteTimeout time.Duration = 30 * time.Second
+const serverIdleTimeout time.Duration = 2 * time.Minute
+
+// Heroku kills a dyno 30 seconds after sending it SIGTERM
+const defaultShutdownTimeout time.Duration = 25 * time.Second
+
+// Largest webhook body that is accepted by default
+const defaultMaxWebhookBodySize int64 = 1 << 20
+
+func newHTTPServer(cfg *Config, handler http.Handler) *http.Server {
+
+	return &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           handler,
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		ReadTimeout:       serverReadTimeout,
+		WriteTimeout:      serverWriteTimeout,
+		IdleTimeout:       serverIdleTimeout,
+		ErrorLog:          rootLogger.StdLogger(LevelError),
+	}
+}
+
+// Serve until SIGTERM or SIGINT is received, then stop accepting webhooks, wait for the queued
+// events to be handled and stop the background work. Returns the status the process should
+// exit with.
+func runServer(server *http.Server, timeout time.Duration, queue *EventQueue, stop context.CancelFunc, clients *channelClients) int {
+
+	failed := make(chan error, 1)
+
+	go func() {
+		failed <- server.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	rootLogger.Info("Listening", "addr", server.Addr)
+
+	select {
+
+	case err := <-failed:
+
+		rootLogger.Error("Server failed", "error", err)
+		stop()
+
+		return 1
+
+	case sig := <-signals:
+
+		rootLogger.Info("Received signal, shutting down", "signal", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	status := 0
+
+	// Stop accepting webhooks, and wait for the ones that are being received to be queued
+	if err := server.Shutdown(ctx); err != nil {
+		rootLogger.Error("Some webhooks were still being received when shutting down", "error", err)
+		status = 1
+	}
+
+	rootLogger.Info("Waiting for queued events to be handled")
+
+	if err := queue.Shutdown(ctx); err != nil {
+		rootLogger.Error("Some events could not be handled before shutting down", "error", err)
+		status = 1
+	}
+
+	stop()
+	clients.wait()
+
+	if tracer != nil {
+
+		if err := tracer.Shutdown(ctx); err != nil {
+			rootLogger.Warn("Some spans could not be exported before shutting down", "error", err)
+		}
+	}
+
+	rootLogger.Info("Shut down")
+
+	return status
+}
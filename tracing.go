@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Where finished spans are sent
+const (
+	TraceExporterNone   = "none"
+	TraceExporterStdout = "stdout"
+	TraceExporterOTLP   = "otlp"
+)
+
+const defaultOTLPEndpoint string = "http://localhost:4318"
+const defaultServiceName string = "line_bot_test_app_v2"
+
+// Spans are exported in batches, at least this often
+const traceExportInterval time.Duration = 5 * time.Second
+const traceBatchSize int = 100
+
+// Spans that are waiting to be exported. Spans are dropped when the buffer is full.
+const traceBufferSize int = 2048
+
+// A timed operation, such as handling a webhook or calling the LINE API. A nil span does nothing,
+// so code can be traced whether tracing is enabled or not.
+type Span struct {
+	tracer *Tracer
+
+	TraceId      string
+	SpanId       string
+	ParentSpanId string
+	Name         string
+	Kind         int
+	StartTime    time.Time
+	EndTime      time.Time
+	Attributes   map[string]interface{}
+	Err          error
+
+	mu    sync.Mutex
+	ended bool
+}
+
+// Span kinds, as defined by OTLP
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+// Records the spans of the process and exports them
+type Tracer struct {
+	serviceName string
+	exporter    SpanExporter
+
+	spans chan *Span
+	done  chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// Sends finished spans somewhere
+type SpanExporter interface {
+	Export(ctx context.Context, serviceName string, spans []*Span) error
+}
+
+// Tracer of the process, or nil if tracing is disabled
+var tracer *Tracer
+
+// Create a tracer and start exporting its spans
+func NewTracer(serviceName string, exporter SpanExporter) *Tracer {
+
+	t := &Tracer{
+		serviceName: serviceName,
+		exporter:    exporter,
+		spans:       make(chan *Span, traceBufferSize),
+		done:        make(chan struct{}),
+	}
+
+	go t.run()
+
+	return t
+}
+
+func (t *Tracer) run() {
+
+	defer close(t.done)
+
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+
+	export := func() {
+
+		if len(batch) == 0 {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), traceExportInterval)
+		defer cancel()
+
+		if err := t.exporter.Export(ctx, t.serviceName, batch); err != nil {
+			rootLogger.Warn("Failed to export spans", "spans", len(batch), "error", err)
+		}
+
+		batch = nil
+	}
+
+	for {
+
+		select {
+
+		case span, ok := <-t.spans:
+
+			if !ok {
+				export()
+				return
+			}
+
+			batch = append(batch, span)
+
+			if len(batch) >= traceBatchSize {
+				export()
+			}
+
+		case <-ticker.C:
+
+			export()
+		}
+	}
+}
+
+// Export the remaining spans and stop. Spans that end afterwards are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+
+	t.mu.Lock()
+	t.closed = true
+	close(t.spans)
+	t.mu.Unlock()
+
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type spanContextKey struct{}
+
+// The span the context belongs to, or nil
+func spanFromContext(ctx context.Context) *Span {
+
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+
+	return span
+}
+
+func withSpan(ctx context.Context, span *Span) context.Context {
+
+	if span == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, span)
+}
+
+// Start a span as a child of the context's span. The attributes are alternating keys and values.
+func startSpan(ctx context.Context, name string, kind int, attributes ...interface{}) (context.Context, *Span) {
+
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer:     tracer,
+		SpanId:     randomHex(8),
+		Name:       name,
+		Kind:       kind,
+		StartTime:  time.Now(),
+		Attributes: make(map[string]interface{}),
+	}
+
+	if parent := spanFromContext(ctx); parent != nil {
+		span.TraceId = parent.TraceId
+		span.ParentSpanId = parent.SpanId
+	} else {
+		span.TraceId = randomHex(16)
+	}
+
+	span.SetAttributes(attributes...)
+
+	return withSpan(ctx, span), span
+}
+
+// Run fn in a span, recording the error it returns
+func trace(ctx context.Context, name string, fn func(ctx context.Context) error, attributes ...interface{}) error {
+
+	ctx, span := startSpan(ctx, name, SpanKindInternal, attributes...)
+
+	err := fn(ctx)
+
+	span.SetError(err)
+	span.End()
+
+	return err
+}
+
+func (s *Span) SetAttributes(attributes ...interface{}) {
+
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i+1 < len(attributes); i += 2 {
+		s.Attributes[fmt.Sprint(attributes[i])] = attributes[i+1]
+	}
+}
+
+// Mark the span as failed if err is not nil
+func (s *Span) SetError(err error) {
+
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.Err = err
+	s.mu.Unlock()
+}
+
+// Finish the span and queue it for export
+func (s *Span) End() {
+
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+
+	s.ended = true
+	s.EndTime = time.Now()
+
+	s.mu.Unlock()
+
+	s.tracer.mu.RLock()
+	defer s.tracer.mu.RUnlock()
+
+	if s.tracer.closed {
+		return
+	}
+
+	select {
+	case s.tracer.spans <- s:
+	default:
+		// Dropping a span is better than slowing down the bot
+	}
+}
+
+// W3C traceparent header value, so that a collector can join the spans of the callee
+func (s *Span) traceparent() string {
+	return "00-" + s.TraceId + "-" + s.SpanId + "-01"
+}
+
+func randomHex(n int) string {
+
+	b := make([]byte, n)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// Writes spans to a writer as JSON, one per line
+type StdoutExporter struct {
+	w io.Writer
+}
+
+func NewStdoutExporter(w io.Writer) *StdoutExporter {
+	return &StdoutExporter{w: w}
+}
+
+func (e *StdoutExporter) Export(ctx context.Context, serviceName string, spans []*Span) error {
+
+	encoder := json.NewEncoder(e.w)
+
+	for _, span := range spans {
+
+		entry := map[string]interface{}{
+			"service":    serviceName,
+			"traceId":    span.TraceId,
+			"spanId":     span.SpanId,
+			"name":       span.Name,
+			"start":      span.StartTime,
+			"durationMs": float64(span.EndTime.Sub(span.StartTime)) / float64(time.Millisecond),
+			"attributes": span.Attributes,
+		}
+
+		if span.ParentSpanId != "" {
+			entry["parentSpanId"] = span.ParentSpanId
+		}
+
+		if span.Err != nil {
+			entry["error"] = span.Err.Error()
+		}
+
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Sends spans to an OpenTelemetry collector with OTLP over HTTP, JSON encoded
+type OTLPExporter struct {
+	Url        string
+	HTTPClient *http.Client
+}
+
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+
+	return &OTLPExporter{
+		Url:        endpoint + "/v1/traces",
+		HTTPClient: &http.Client{},
+	}
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpAttributes(attributes map[string]interface{}) []otlpKeyValue {
+
+	kvs := make([]otlpKeyValue, 0, len(attributes))
+
+	// Sorted, so that the same span is always encoded the same way
+	keys := make([]string, 0, len(attributes))
+
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+
+		value := attributes[key]
+
+		var v map[string]interface{}
+
+		switch value := value.(type) {
+		case bool:
+			v = map[string]interface{}{"boolValue": value}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": value}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+		}
+
+		kvs = append(kvs, otlpKeyValue{Key: key, Value: v})
+	}
+
+	return kvs
+}
+
+func (e *OTLPExporter) Export(ctx context.Context, serviceName string, spans []*Span) error {
+
+	var otlpSpans []map[string]interface{}
+
+	for _, span := range spans {
+
+		// Unset, or error
+		status := map[string]interface{}{"code": 0}
+
+		if span.Err != nil {
+			status = map[string]interface{}{"code": 2, "message": span.Err.Error()}
+		}
+
+		otlpSpan := map[string]interface{}{
+			"traceId":           span.TraceId,
+			"spanId":            span.SpanId,
+			"name":              span.Name,
+			"kind":              span.Kind,
+			"startTimeUnixNano": strconv.FormatInt(span.StartTime.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+			"attributes":        otlpAttributes(span.Attributes),
+			"status":            status,
+		}
+
+		if span.ParentSpanId != "" {
+			otlpSpan["parentSpanId"] = span.ParentSpanId
+		}
+
+		otlpSpans = append(otlpSpans, otlpSpan)
+	}
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": defaultServiceName},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+
+	body, err := json.Marshal(payload)
+
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", e.Url, bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.HTTPClient.Do(req.WithContext(ctx))
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Keeps the spans it is given
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (e *recordingExporter) Export(ctx context.Context, serviceName string, spans []*Span) error {
+
+	e.mu.Lock()
+	e.spans = append(e.spans, spans...)
+	e.mu.Unlock()
+
+	return nil
+}
+
+func TestSpanTraceparent(t *testing.T) {
+
+	span := &Span{TraceId: "4bf92f3577b34da6a3ce929d0e0e4736", SpanId: "00f067aa0ba902b7"}
+
+	if got := span.traceparent(); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("traceparent = %q", got)
+	}
+}
+
+// Calls to the LINE API are traced, and the trace is passed on in the traceparent header
+func TestClientTracing(t *testing.T) {
+
+	exporter := &recordingExporter{}
+	tracer = NewTracer("test", exporter)
+	defer func() { tracer = nil }()
+
+	s := newFakeLINEServer()
+	defer s.Close()
+
+	ctx, parent := startSpan(context.Background(), "webhook", SpanKindServer)
+
+	if _, err := s.client().GetProfile(ctx, "U123"); err != nil {
+		t.Fatal(err)
+	}
+
+	parent.End()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := tracer.Shutdown(shutdownCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(exporter.spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(exporter.spans))
+	}
+
+	span := exporter.spans[0]
+
+	if span.Name != "GET profile" || span.TraceId != parent.TraceId || span.ParentSpanId != parent.SpanId {
+		t.Errorf("span = %+v, want a child of the webhook span", span)
+	}
+
+	header := s.RequestsTo("profile/U123")[0].Header.Get("traceparent")
+
+	if !regexp.MustCompile(`^00-[0-9a-f]{32}-[0-9a-f]{16}-01$`).MatchString(header) || header != span.traceparent() {
+		t.Errorf("traceparent = %q, want %q", header, span.traceparent())
+	}
+
+	// User IDs in the path are not recorded
+	for key, value := range span.Attributes {
+
+		if text, ok := value.(string); ok && strings.Contains(text, "U123") {
+			t.Errorf("attribute %s = %q contains the user ID", key, text)
+		}
+	}
+
+	if span.Attributes["line.endpoint"] != "profile" || span.Attributes["http.status_code"] != http.StatusOK {
+		t.Errorf("attributes = %v", span.Attributes)
+	}
+}
+
+func TestOTLPExporterPayload(t *testing.T) {
+
+	var body []byte
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("request to %s with Content-Type %q", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer collector.Close()
+
+	start := time.Unix(1700000000, 0)
+
+	spans := []*Span{
+		{
+			TraceId:    "4bf92f3577b34da6a3ce929d0e0e4736",
+			SpanId:     "00f067aa0ba902b7",
+			Name:       "webhook",
+			Kind:       SpanKindServer,
+			StartTime:  start,
+			EndTime:    start.Add(1500 * time.Millisecond),
+			Attributes: map[string]interface{}{"channel": "default", "events": 2, "skipped": false, "queuedMs": 1.5},
+		},
+		{
+			TraceId:      "4bf92f3577b34da6a3ce929d0e0e4736",
+			SpanId:       "b7ad6b7169203331",
+			ParentSpanId: "00f067aa0ba902b7",
+			Name:         "GET profile",
+			Kind:         SpanKindClient,
+			StartTime:    start,
+			EndTime:      start.Add(time.Millisecond),
+			Attributes:   map[string]interface{}{},
+			Err:          errors.New("401 Unauthorized"),
+		},
+	}
+
+	if err := NewOTLPExporter(collector.URL).Export(context.Background(), "test-service", spans); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"test-service"}}]},` +
+		`"scopeSpans":[{"scope":{"name":"line_bot_test_app_v2"},"spans":[` +
+		`{"attributes":[{"key":"channel","value":{"stringValue":"default"}},{"key":"events","value":{"intValue":"2"}},` +
+		`{"key":"queuedMs","value":{"doubleValue":1.5}},{"key":"skipped","value":{"boolValue":false}}],` +
+		`"endTimeUnixNano":"1700000001500000000","kind":2,"name":"webhook","spanId":"00f067aa0ba902b7",` +
+		`"startTimeUnixNano":"1700000000000000000","status":{"code":0},"traceId":"4bf92f3577b34da6a3ce929d0e0e4736"},` +
+		`{"attributes":[],"endTimeUnixNano":"1700000000001000000","kind":3,"name":"GET profile",` +
+		`"parentSpanId":"00f067aa0ba902b7","spanId":"b7ad6b7169203331","startTimeUnixNano":"1700000000000000000",` +
+		`"status":{"code":2,"message":"401 Unauthorized"},"traceId":"4bf92f3577b34da6a3ce929d0e0e4736"}]}]}]}`
+
+	if string(body) != want {
+		t.Errorf("payload =\n%s\nwant\n%s", body, want)
+	}
+}
+
+func TestOTLPExporterCollectorError(t *testing.T) {
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer collector.Close()
+
+	span := &Span{TraceId: "4bf92f3577b34da6a3ce929d0e0e4736", SpanId: "00f067aa0ba902b7", Attributes: map[string]interface{}{}}
+
+	if err := NewOTLPExporter(collector.URL).Export(context.Background(), "test-service", []*Span{span}); err == nil {
+		t.Error("collector error was not returned")
+	}
+}